@@ -1,29 +1,185 @@
 package cmd
 
 import (
-    "flag"
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "os"
     "runtime"
+    "strings"
     "time"
 
     tp "tidepool/tidepool"
 )
 
-func ParseAndRun() (*tp.Env, <-chan *tp.Delta) {
-    w := flag.Int("width", 256, "Environment width")
-    h := flag.Int("height", 256, "Environment height")
-    g := flag.Int("genome", 1024, "Genome size")
-    p := flag.Float64("pop", 0.01, "Initial population percent")
-    s := flag.Int64("seed", -1, "Environment seed")
-    t := flag.Duration("tick", time.Millisecond, "Clock tick frequency")
+// ParseAndRun parses the command line and starts the experiment, or the
+// replay of a recording.
+func (x *Experiment) ParseAndRun() (*tp.Env, <-chan *tp.Delta) {
+    if err := x.Parse(); err != nil {
+        log.Fatal(err)
+    }
+    env, dts, err := x.Run()
+    if err != nil {
+        log.Fatal(err)
+    }
+    return env, dts
+}
 
-    flag.Parse()
+// Run starts the experiment, or the replay of a recording.
+func (x *Experiment) Run() (*tp.Env, <-chan *tp.Delta, error) {
+    dts := make(chan *tp.Delta)
+    tick := time.Duration(x.Tick)
 
-    pop := int32(*p * float64(*w * *h))
-    env := tp.NewEnv(int32(*w), int32(*h), int32(*g), pop, *s)
+    if x.Replay != "" {
+        f, err := os.Open(x.Replay)
+        if err != nil {
+            return nil, nil, err
+        }
+        rp, err := tp.OpenReplay(f)
+        if err != nil {
+            f.Close()
+            return nil, nil, err
+        }
+        env, err := rp.NewEnv()
+        if err != nil {
+            f.Close()
+            return nil, nil, err
+        }
+        x.Width, x.Height, x.Genome = int(env.Width), int(env.Height),
+            int(env.GenomeSize)
+        x.Seed = env.Seed
+        x.Config = env.GetConfig()
+        go func() {
+            defer f.Close()
+            if err := env.Replay(rp, x.Start, tick, dts); err != nil {
+                log.Println(err)
+            }
+        }()
+        return env, dts, nil
+    }
 
-    dts := make(chan *tp.Delta)
+    env, err := x.newEnv()
+    if err != nil {
+        return nil, nil, err
+    }
 
-    go env.Run(runtime.NumCPU(), *t, dts)
+    schedule := append([]Change(nil), x.Schedule...)
+    if x.Output.Record == "" && len(schedule) == 0 {
+        go env.Run(runtime.GOMAXPROCS(0), tick, dts)
+        return env, dts, nil
+    }
 
-    return env, dts
+    var rec *tp.Recorder
+    var f *os.File
+    if x.Output.Record != "" {
+        f, err = os.Create(x.Output.Record)
+        if err != nil {
+            return nil, nil, err
+        }
+        cells, _ := env.GetCells()
+        rec, err = tp.NewRecorder(f, env, cells, x.Output.Keyframe)
+        if err != nil {
+            f.Close()
+            return nil, nil, err
+        }
+    }
+
+    out := make(chan *tp.Delta)
+    go env.Run(runtime.GOMAXPROCS(0), tick, dts)
+    go func() {
+        defer close(out)
+        if f != nil {
+            defer f.Close()
+        }
+        for dt := range dts {
+            if len(schedule) > 0 {
+                if schedule, err = applySchedule(env, schedule, dt); err != nil {
+                    log.Println("schedule:", err)
+                }
+            }
+            if rec != nil {
+                if err := rec.Record(dt); err != nil {
+                    log.Println("recording stopped:", err)
+                    rec = nil
+                }
+            }
+            out <- dt
+        }
+        if rec != nil {
+            if err := rec.Flush(); err != nil {
+                log.Println(err)
+            }
+        }
+    }()
+
+    return env, out, nil
+}
+
+// Snapshot returns a copy of the grid of a running env. Deltas received from
+// dts while waiting are part of the copy, so only their stats are returned.
+// If the env stops first, the copy is of its final grid.
+func Snapshot(env *tp.Env, dts <-chan *tp.Delta) ([]*tp.Cell, tp.Stats) {
+    stats := make(tp.Stats)
+    var cells []*tp.Cell
+    done := make(chan struct{})
+    f := func(g tp.Grid) error {
+        cells = make([]*tp.Cell, g.Len())
+        for i := range cells {
+            cells[i] = g.Cell(int32(i)).Copy()
+        }
+        close(done)
+        return nil
+    }
+
+    errs := make(chan error, 1)
+    go func() {
+        errs <- env.View(context.Background(), f)
+    }()
+    for {
+        select {
+        case err := <-errs:
+            if err != nil {
+                return nil, stats
+            }
+            return cells, stats
+        case dt, ok := <-dts:
+            if !ok {
+                // The env stopped; wait for View to copy its final grid.
+                dts = nil
+                continue
+            }
+            select {
+            case <-done:
+                // Sent after the copy was taken.
+                for _, c := range dt.Cells {
+                    cells[c.Idx] = c
+                }
+            default:
+            }
+            stats.Add(dt.Stats)
+        }
+    }
+}
+
+func WriteGenotypes(w io.Writer, gs []tp.Genotype) {
+    for i, g := range gs {
+        fmt.Fprintf(w, "#%d %016x abundance=%d first=%d peak=%d@%d\n",
+            i + 1, g.Hash, g.Abundance, g.FirstSeen, g.Peak, g.PeakTick)
+        fmt.Fprintf(w, "    %s\n\n",
+            strings.Join(g.Genome.Disassemble(), "\n    "))
+    }
+}
+
+// WriteHistory writes hist as CSV to the file at path.
+func WriteHistory(path string, hist *tp.History) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := hist.WriteCSV(f, 0, -1); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
 }
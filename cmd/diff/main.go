@@ -0,0 +1,119 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+
+    tp "tidepool/tidepool"
+    "tidepool/tidepool/gene"
+)
+
+func usage() {
+    fmt.Fprintf(flag.CommandLine.Output(),
+        "usage: %s [flags] GENOME GENOME\n" +
+        "       %s [flags] -snapshot FILE ID ID\n\n", os.Args[0], os.Args[0])
+    flag.PrintDefaults()
+}
+
+// readSnapshot reads a stream of JSON deltas, such as the output of the json
+// command, and returns the latest state of every cell by ID.
+func readSnapshot(path string) (map[int64]*tp.Cell, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    cells := make(map[int32]*tp.Cell)
+    dec := json.NewDecoder(f)
+    for {
+        var dt tp.Delta
+        if err := dec.Decode(&dt); err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        for _, c := range dt.Cells {
+            cells[c.Idx] = c
+        }
+    }
+
+    ids := make(map[int64]*tp.Cell)
+    for _, c := range cells {
+        if c.ID != 0 {
+            ids[c.ID] = c
+        }
+    }
+    return ids, nil
+}
+
+func genomes(snapshot string, args []string) (gene.Genome, gene.Genome, error) {
+    if snapshot == "" {
+        a, err := gene.ParseGenome(args[0])
+        if err != nil {
+            return nil, nil, err
+        }
+        b, err := gene.ParseGenome(args[1])
+        return a, b, err
+    }
+
+    cells, err := readSnapshot(snapshot)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    gs := make([]gene.Genome, 2)
+    for i, arg := range args {
+        id, err := strconv.ParseInt(arg, 10, 64)
+        if err != nil {
+            return nil, nil, err
+        }
+        c, ok := cells[id]
+        if !ok {
+            return nil, nil, fmt.Errorf("cell %d not found in snapshot", id)
+        }
+        gs[i] = c.Genome
+    }
+    return gs[0], gs[1], nil
+}
+
+func run() error {
+    snapshot := flag.String("snapshot", "", "Read cells from JSON delta file")
+    js := flag.Bool("json", false, "Write alignment as JSON")
+    width := flag.Int("width", 64, "Alignment text width")
+
+    flag.Usage = usage
+    flag.Parse()
+
+    if flag.NArg() != 2 {
+        usage()
+        return errors.New("expected two genomes or cell IDs")
+    }
+
+    a, b, err := genomes(*snapshot, flag.Args())
+    if err != nil {
+        return err
+    }
+
+    al := gene.Align(a, b)
+
+    if *js {
+        al.Edits = al.Changes()
+        return json.NewEncoder(os.Stdout).Encode(al)
+    }
+    return al.WriteText(os.Stdout, *width)
+}
+
+func main() {
+    if err := run(); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+}
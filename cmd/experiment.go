@@ -0,0 +1,286 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package cmd
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "time"
+
+    tp "tidepool/tidepool"
+    "tidepool/tidepool/gene"
+)
+
+// Duration is a time.Duration written as a string such as "1ms" in
+// experiment files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+        return err
+    }
+    v, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = Duration(v)
+    return nil
+}
+
+// Organism is a cell placed on the grid before the run starts.
+type Organism struct {
+    X int32
+    Y int32
+    Genome gene.Genome
+    Energy int64
+    Generation int64
+}
+
+// Change updates the Config and RNG of the env once the run reaches Tick.
+// Fields missing from Config and RNG keep their current values.
+type Change struct {
+    Tick int64
+    Config json.RawMessage `json:",omitempty"`
+    RNG json.RawMessage `json:",omitempty"`
+}
+
+type Output struct {
+    Record string `json:",omitempty"`
+    Keyframe int64
+    History string `json:",omitempty"`
+    HistoryInterval int64
+    HistorySize int
+    Genotypes int `json:",omitempty"`
+    Format string `json:",omitempty"`
+}
+
+// Experiment describes a run. It is read from a JSON file given with the
+// -experiment flag; flags given on the command line override its values.
+type Experiment struct {
+    Width int
+    Height int
+    Genome int
+    // Initial population as a fraction of the grid.
+    Pop float64
+    Seed int64
+    Tick Duration
+    // Only "torus" is supported.
+    Topology string
+    Config tp.Config
+    RNG tp.DefaultRNG
+    Schedule []Change `json:",omitempty"`
+    Organisms []Organism `json:",omitempty"`
+    Replay string `json:",omitempty"`
+    Start int64 `json:",omitempty"`
+    Output Output
+
+    path string
+}
+
+// NewExperiment returns an Experiment with default values and registers
+// its flags. Commands may register further flags bound to its fields before
+// calling ParseAndRun.
+func NewExperiment() *Experiment {
+    x := &Experiment{
+        Topology: "torus",
+        Config: tp.DefaultConfig(),
+        RNG: tp.NewDefaultRNG(),
+    }
+
+    flag.StringVar(&x.path, "experiment", "", "Read experiment from JSON file")
+    flag.IntVar(&x.Width, "width", 256, "Environment width")
+    flag.IntVar(&x.Height, "height", 256, "Environment height")
+    flag.IntVar(&x.Genome, "genome", 1024, "Genome size")
+    flag.Float64Var(&x.Pop, "pop", 0.01, "Initial population percent")
+    flag.Int64Var(&x.Seed, "seed", -1, "Environment seed")
+    flag.DurationVar((*time.Duration)(&x.Tick), "tick", time.Millisecond,
+        "Clock tick frequency")
+
+    flag.Int64Var(&x.Config.InflowFrequency, "inflow-frequency",
+        x.Config.InflowFrequency, "Ticks between energy inflows")
+    flag.Int64Var(&x.Config.ViableCellGeneration, "viable-generation",
+        x.Config.ViableCellGeneration, "Generation at which cells are viable")
+    flag.Int64Var(&x.Config.FailedKillPenalty, "failed-kill-penalty",
+        x.Config.FailedKillPenalty, "Energy divisor for failed kills")
+    flag.Int64Var(&x.Config.DiversityInterval, "diversity",
+        x.Config.DiversityInterval,
+        "Ticks between diversity measurements (0 disables)")
+    flag.Float64Var(&x.RNG.MutationRate, "mutation-rate",
+        x.RNG.MutationRate, "Probability of a mutation per copied gene")
+    flag.Int64Var(&x.RNG.InflowRateBase, "inflow-base",
+        x.RNG.InflowRateBase, "Minimum energy per inflow")
+    flag.Int64Var(&x.RNG.InflowRateModifier, "inflow-modifier",
+        x.RNG.InflowRateModifier, "Range of random energy added per inflow")
+
+    flag.StringVar(&x.Output.Record, "record", "", "Record the run to file")
+    flag.Int64Var(&x.Output.Keyframe, "keyframe", 1000,
+        "Ticks between recording keyframes")
+    flag.Int64Var(&x.Output.HistoryInterval, "history-interval", 100,
+        "Ticks between stats history samples")
+    flag.IntVar(&x.Output.HistorySize, "history-size", 1024,
+        "Number of stats history samples per resolution level")
+    flag.StringVar(&x.Replay, "replay", "",
+        "Replay a recording instead of running")
+    flag.Int64Var(&x.Start, "start", 0, "Tick to start replaying from")
+
+    return x
+}
+
+// Parse parses the command line, reading the experiment file if one is
+// given. Flags are parsed again after reading the file so that they take
+// precedence over it.
+func (x *Experiment) Parse() error {
+    flag.Parse()
+
+    if x.path != "" {
+        f, err := os.Open(x.path)
+        if err != nil {
+            return err
+        }
+        err = x.Decode(f)
+        f.Close()
+        if err != nil {
+            return fmt.Errorf("%s: %v", x.path, err)
+        }
+        flag.Parse()
+    }
+
+    return x.Validate()
+}
+
+// Decode reads the fields of x given in JSON from r, rejecting unknown
+// fields.
+func (x *Experiment) Decode(r io.Reader) error {
+    d := json.NewDecoder(r)
+    d.DisallowUnknownFields()
+    return d.Decode(x)
+}
+
+// Base returns a copy of x without its random seed, organisms, schedule and
+// files, to describe further experiments on top of the same defaults.
+func (x *Experiment) Base() *Experiment {
+    b := *x
+    b.Seed = -1
+    b.Schedule = nil
+    b.Organisms = nil
+    b.Replay = ""
+    b.Start = 0
+    b.Output.Record = ""
+    b.Output.History = ""
+    b.path = ""
+    return &b
+}
+
+func (x *Experiment) Validate() error {
+    if x.Topology != "torus" {
+        return fmt.Errorf("unsupported topology: %s", x.Topology)
+    }
+    if x.Pop < 0 || x.Pop > 1 {
+        return fmt.Errorf("initial population must be between 0 and 1, got %g",
+            x.Pop)
+    }
+    if x.Tick <= 0 {
+        return fmt.Errorf("tick must be positive, got %s", time.Duration(x.Tick))
+    }
+    if err := x.Config.Validate(); err != nil {
+        return err
+    }
+    if err := x.RNG.Validate(); err != nil {
+        return err
+    }
+
+    sort.SliceStable(x.Schedule, func(i, j int) bool {
+        return x.Schedule[i].Tick < x.Schedule[j].Tick
+    })
+    c, r := x.Config, x.RNG
+    for _, ch := range x.Schedule {
+        if err := ch.apply(&c, &r); err != nil {
+            return fmt.Errorf("schedule at tick %d: %v", ch.Tick, err)
+        }
+    }
+
+    return nil
+}
+
+func (ch Change) apply(c *tp.Config, r *tp.DefaultRNG) error {
+    nc, nr := *c, *r
+    if len(ch.Config) > 0 {
+        if err := json.Unmarshal(ch.Config, &nc); err != nil {
+            return err
+        }
+        if err := nc.Validate(); err != nil {
+            return err
+        }
+    }
+    if len(ch.RNG) > 0 {
+        if err := json.Unmarshal(ch.RNG, &nr); err != nil {
+            return err
+        }
+        if err := nr.Validate(); err != nil {
+            return err
+        }
+    }
+    *c, *r = nc, nr
+    return nil
+}
+
+// newEnv creates the env described by x and places its organisms.
+func (x *Experiment) newEnv() (*tp.Env, error) {
+    pop := int32(x.Pop * float64(x.Width * x.Height))
+    env, err := tp.NewEnv(int32(x.Width), int32(x.Height), int32(x.Genome),
+        pop, x.Seed)
+    if err != nil {
+        return nil, err
+    }
+    x.Seed = env.Seed
+
+    if err := env.SetConfig(x.Config); err != nil {
+        return nil, err
+    }
+    if err := env.SetRNG(x.RNG); err != nil {
+        return nil, err
+    }
+
+    for i, o := range x.Organisms {
+        err := env.PlaceCell(o.X, o.Y, o.Genome, o.Energy, o.Generation)
+        if err != nil {
+            return nil, fmt.Errorf("organism %d: %v", i, err)
+        }
+    }
+
+    return env, nil
+}
+
+// applySchedule applies the changes in s whose tick has been reached by dt
+// and returns the remaining changes.
+func applySchedule(env *tp.Env, s []Change, dt *tp.Delta) ([]Change, error) {
+    for len(s) > 0 && dt.Stats["Ticks"] >= s[0].Tick {
+        ch := s[0]
+        s = s[1:]
+
+        c := env.GetConfig()
+        r, ok := env.GetRNG().(tp.DefaultRNG)
+        if !ok {
+            return s, fmt.Errorf("env does not use the default RNG")
+        }
+        if err := ch.apply(&c, &r); err != nil {
+            return s, err
+        }
+        if err := env.SetConfig(c); err != nil {
+            return s, err
+        }
+        if err := env.SetRNG(r); err != nil {
+            return s, err
+        }
+    }
+    return s, nil
+}
@@ -3,35 +3,118 @@
 package main
 
 import (
+    "bufio"
     "encoding/json"
+    "flag"
     "fmt"
+    "log"
+    "net/http"
     "os"
     "os/signal"
+    "sync"
+    "syscall"
 
     "tidepool/cmd"
+    "tidepool/metrics"
+    tp "tidepool/tidepool"
 )
 
 func main() {
-    env, dts := cmd.ParseAndRun()
+    x := cmd.NewExperiment()
+    flag.StringVar(&x.Output.History, "history", "",
+        "Write stats history as CSV to file on exit")
+    flag.IntVar(&x.Output.Genotypes, "genotypes", 0,
+        "Write the top N genotypes to stderr on exit")
+    flag.StringVar(&x.Output.Format, "format", "json",
+        "Delta output format (json or binary)")
+    metricsAddr := flag.String("metrics-addr", "",
+        "Serve OpenMetrics on this address at /metrics")
+
+    env, dts := x.ParseAndRun()
+
+    format := x.Output.Format
+    if format != "json" && format != "binary" {
+        fmt.Fprintln(os.Stderr, "invalid format:", format)
+        os.Exit(2)
+    }
+    out := bufio.NewWriter(os.Stdout)
+
+    // The effective experiment precedes the deltas for provenance; binary
+    // output has no room for it and gets it on stderr.
+    js, err := json.Marshal(struct{ Experiment *cmd.Experiment }{x})
+    if err != nil {
+        log.Fatal(err)
+    }
+    if format == "json" {
+        out.Write(js)
+        out.WriteByte('\n')
+    } else {
+        fmt.Fprintln(os.Stderr, string(js))
+    }
 
     sig := make(chan os.Signal, 1)
-    signal.Notify(sig, os.Interrupt)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
     defer signal.Stop(sig)
 
+    stats := make(tp.Stats)
+    statsMutex := &sync.Mutex{}
+    hist := tp.NewHistory(x.Output.HistoryInterval, x.Output.HistorySize, 4, 4)
+    tracker := tp.NewTracker()
+
+    if *metricsAddr != "" {
+        mux := http.NewServeMux()
+        mux.Handle("/metrics", metrics.NewExporter(env, func() tp.Stats {
+            statsMutex.Lock()
+            defer statsMutex.Unlock()
+            return stats.Copy()
+        }, nil))
+        go func() {
+            if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+                log.Fatal(err)
+            }
+        }()
+    }
+
     for {
         select {
         case <-sig:
             env.Stop()
         case dt, ok := <-dts:
             if !ok {
+                if x.Output.History != "" {
+                    if err := cmd.WriteHistory(x.Output.History, hist); err != nil {
+                        fmt.Fprintln(os.Stderr, err)
+                        os.Exit(1)
+                    }
+                }
+                if err := out.Flush(); err != nil {
+                    fmt.Fprintln(os.Stderr, err)
+                    os.Exit(1)
+                }
+                if x.Output.Genotypes > 0 {
+                    cmd.WriteGenotypes(os.Stderr, tracker.Top(x.Output.Genotypes))
+                }
                 return
             }
-            json, err := json.Marshal(dt)
+            tracker.Apply(dt, env.GetConfig())
+            statsMutex.Lock()
+            stats.Add(dt.Stats)
+            statsMutex.Unlock()
+            hist.Add(stats)
+            var err error
+            if format == "binary" {
+                err = tp.WriteDelta(out, dt)
+            } else {
+                var js []byte
+                if js, err = json.Marshal(dt); err == nil {
+                    out.Write(js)
+                    err = out.WriteByte('\n')
+                }
+            }
             if err != nil {
                 fmt.Fprintln(os.Stderr, err)
                 os.Exit(1)
             }
-            fmt.Println(string(json))
         }
     }
 }
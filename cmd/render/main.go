@@ -0,0 +1,131 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package main
+
+import (
+    "flag"
+    "fmt"
+    "image"
+    "image/color/palette"
+    "image/draw"
+    "image/gif"
+    "image/png"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "tidepool/cmd"
+    tp "tidepool/tidepool"
+)
+
+func writePNG(path string, img image.Image) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := png.Encode(f, img); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+func writeGIF(path string, anim *gif.GIF) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := gif.EncodeAll(f, anim); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// paletted converts img to the Plan 9 palette without dithering, so that
+// cells keep flat colours.
+func paletted(img image.Image) *image.Paletted {
+    p := image.NewPaletted(img.Bounds(), palette.Plan9)
+    draw.Draw(p, p.Rect, img, img.Bounds().Min, draw.Src)
+    return p
+}
+
+func main() {
+    scheme := flag.String("scheme", "genotype", "Colour scheme (" +
+        strings.Join(tp.ColourSchemeNames(), ", ") + ")")
+    scale := flag.Int("scale", 4, "Pixels per cell")
+    every := flag.Int64("every", 1000, "Ticks between frames")
+    frames := flag.Int("frames", 10, "Number of frames to render")
+    out := flag.String("out", "", "Write frames as PNG files to directory")
+    gifPath := flag.String("gif", "", "Write frames as animated GIF to file")
+    delay := flag.Int("delay", 10, "GIF frame delay in 100ths of a second")
+    x := cmd.NewExperiment()
+
+    env, dts := x.ParseAndRun()
+
+    cs, err := tp.ParseColourScheme(*scheme)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if *out == "" && *gifPath == "" {
+        log.Fatal("nothing to do: use -out or -gif")
+    }
+    if *every < 1 || *frames < 1 {
+        log.Fatal("every and frames must be at least 1")
+    }
+    if *out != "" {
+        if err := os.MkdirAll(*out, 0755); err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    cells, stats := cmd.Snapshot(env, dts)
+    if cells == nil {
+        log.Fatal("env stopped before start")
+    }
+
+    anim := &gif.GIF{}
+    next := stats["Ticks"]
+    n := 0
+
+    for {
+        if stats["Ticks"] >= next {
+            img := tp.Render(cells, env.Width, env.Height, env.GetConfig(),
+                cs, *scale)
+            if *out != "" {
+                path := filepath.Join(*out,
+                    fmt.Sprintf("frame-%06d.png", stats["Ticks"]))
+                if err := writePNG(path, img); err != nil {
+                    log.Fatal(err)
+                }
+            }
+            if *gifPath != "" {
+                anim.Image = append(anim.Image, paletted(img))
+                anim.Delay = append(anim.Delay, *delay)
+            }
+            n++
+            next = stats["Ticks"] + *every
+            if n == *frames {
+                break
+            }
+        }
+
+        dt, ok := <-dts
+        if !ok {
+            break
+        }
+        for _, c := range dt.Cells {
+            cells[c.Idx] = c
+        }
+        stats.Add(dt.Stats)
+    }
+
+    if *gifPath != "" {
+        if err := writeGIF(*gifPath, anim); err != nil {
+            log.Fatal(err)
+        }
+    }
+    log.Printf("rendered %d frames", n)
+    env.Stop()
+}
@@ -0,0 +1,434 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "tidepool/cmd"
+    tp "tidepool/tidepool"
+)
+
+const (
+    statusOK = "ok"
+    statusFailed = "failed"
+    statusTimeout = "timeout"
+)
+
+// Spec describes a sweep. Parameters maps dotted paths into the experiment,
+// such as "RNG.MutationRate" or "Genome", to the values they take; every
+// combination of values is run.
+type Spec struct {
+    Base json.RawMessage
+    Parameters map[string][]interface{}
+    Ticks int64
+    Timeout cmd.Duration
+}
+
+type Run struct {
+    ID string
+    Params map[string]interface{}
+    Experiment json.RawMessage
+}
+
+// Result is written to result.json in the directory of each run. Runs with a
+// result are skipped when a sweep is resumed.
+type Result struct {
+    ID string
+    Params map[string]interface{}
+    Status string
+    Error string `json:",omitempty"`
+    Ticks int64
+    Duration cmd.Duration
+    Stats tp.Stats `json:",omitempty"`
+}
+
+func usage() {
+    fmt.Fprintf(flag.CommandLine.Output(),
+        "usage: %s [flags] SPEC\n\n", os.Args[0])
+    flag.PrintDefaults()
+}
+
+func readJSON(path string, v interface{}) error {
+    b, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    if err := decode(b, v); err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    return nil
+}
+
+// decode unmarshals b into v, keeping numbers intact so that large seeds
+// survive the round trip through interface{} values.
+func decode(b []byte, v interface{}) error {
+    d := json.NewDecoder(bytes.NewReader(b))
+    d.UseNumber()
+    return d.Decode(v)
+}
+
+func writeJSON(path string, v interface{}) error {
+    b, err := json.MarshalIndent(v, "", "    ")
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// set assigns v to the dotted path p in m, which must already exist.
+func set(m map[string]interface{}, p string, v interface{}) error {
+    keys := strings.Split(p, ".")
+    for _, k := range keys[:len(keys) - 1] {
+        n, ok := m[k].(map[string]interface{})
+        if !ok {
+            return fmt.Errorf("invalid parameter: %s", p)
+        }
+        m = n
+    }
+    k := keys[len(keys) - 1]
+    if _, ok := m[k]; !ok {
+        return fmt.Errorf("invalid parameter: %s", p)
+    }
+    m[k] = v
+    return nil
+}
+
+// expand returns a run for every combination of parameter values. Runs are
+// numbered in a fixed order so that a resumed sweep finds its earlier runs.
+func expand(s Spec, base []byte) ([]Run, error) {
+    names := make([]string, 0, len(s.Parameters))
+    for n, vs := range s.Parameters {
+        if len(vs) == 0 {
+            return nil, fmt.Errorf("parameter %s has no values", n)
+        }
+        names = append(names, n)
+    }
+    sort.Strings(names)
+
+    n := 1
+    for _, name := range names {
+        n *= len(s.Parameters[name])
+    }
+
+    runs := make([]Run, n)
+    for i := range runs {
+        var m map[string]interface{}
+        if err := decode(base, &m); err != nil {
+            return nil, err
+        }
+        params := make(map[string]interface{})
+        j := i
+        for k := len(names) - 1; k >= 0; k-- {
+            vs := s.Parameters[names[k]]
+            params[names[k]] = vs[j % len(vs)]
+            if err := set(m, names[k], vs[j % len(vs)]); err != nil {
+                return nil, err
+            }
+            j /= len(vs)
+        }
+
+        b, err := json.Marshal(m)
+        if err != nil {
+            return nil, err
+        }
+        var x cmd.Experiment
+        d := json.NewDecoder(bytes.NewReader(b))
+        d.DisallowUnknownFields()
+        if err := d.Decode(&x); err != nil {
+            return nil, fmt.Errorf("run %d: %v", i, err)
+        }
+        if err := x.Validate(); err != nil {
+            return nil, fmt.Errorf("run %d: %v", i, err)
+        }
+
+        runs[i] = Run{
+            ID: fmt.Sprintf("%04d", i),
+            Params: params,
+            Experiment: b,
+        }
+    }
+
+    return runs, nil
+}
+
+// prepare creates the directory of r and returns whether it already has a
+// result. It fails if the run was created by a different sweep.
+func prepare(dir string, r Run) (bool, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return false, err
+    }
+    path := filepath.Join(dir, "experiment.json")
+    if b, err := ioutil.ReadFile(path); err == nil {
+        if !bytes.Equal(b, r.Experiment) {
+            return false, fmt.Errorf("run %s: experiment differs from %s",
+                r.ID, path)
+        }
+    } else if err := ioutil.WriteFile(path, r.Experiment, 0644); err != nil {
+        return false, err
+    }
+    _, err := os.Stat(filepath.Join(dir, "result.json"))
+    return err == nil, nil
+}
+
+// execute runs r in a worker process limited to procs CPUs, which writes
+// stats.json and history.csv to dir.
+func execute(dir string, r Run, ticks int64, timeout time.Duration,
+    procs int) Result {
+    res := Result{
+        ID: r.ID,
+        Params: r.Params,
+        Status: statusOK,
+    }
+
+    ctx := context.Background()
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+
+    logf, err := os.Create(filepath.Join(dir, "log.txt"))
+    if err != nil {
+        res.Status, res.Error = statusFailed, err.Error()
+        return res
+    }
+    defer logf.Close()
+
+    self, err := os.Executable()
+    if err != nil {
+        res.Status, res.Error = statusFailed, err.Error()
+        return res
+    }
+    // Do not mistake the stats of an earlier attempt for this one's.
+    os.Remove(filepath.Join(dir, "stats.json"))
+
+    c := exec.CommandContext(ctx, self, "worker",
+        "-experiment", filepath.Join(dir, "experiment.json"),
+        "-ticks", strconv.FormatInt(ticks, 10),
+        "-out", dir)
+    c.Env = append(os.Environ(), "GOMAXPROCS=" + strconv.Itoa(procs))
+    c.Stdout = logf
+    c.Stderr = logf
+
+    start := time.Now()
+    err = c.Run()
+    res.Duration = cmd.Duration(time.Since(start))
+
+    if ctx.Err() == context.DeadlineExceeded {
+        res.Status, res.Error = statusTimeout, ctx.Err().Error()
+    } else if err != nil {
+        res.Status, res.Error = statusFailed, err.Error()
+    } else if err := readJSON(filepath.Join(dir, "stats.json"),
+        &res.Stats); err != nil {
+        res.Status, res.Error = statusFailed, err.Error()
+    }
+    res.Ticks = res.Stats["Ticks"]
+
+    return res
+}
+
+// writeSummary writes one row per run with its parameters and final stats.
+func writeSummary(path string, names []string, rs []Result) error {
+    statSet := make(map[string]bool)
+    for _, r := range rs {
+        for n := range r.Stats {
+            statSet[n] = true
+        }
+    }
+    stats := make([]string, 0, len(statSet))
+    for n := range statSet {
+        stats = append(stats, n)
+    }
+    sort.Strings(stats)
+
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    w := csv.NewWriter(f)
+
+    header := []string{"ID", "Status", "Error", "Seconds"}
+    header = append(header, names...)
+    w.Write(append(header, stats...))
+
+    for _, r := range rs {
+        row := []string{r.ID, r.Status, r.Error,
+            strconv.FormatFloat(time.Duration(r.Duration).Seconds(), 'f', 3, 64)}
+        for _, n := range names {
+            v, _ := json.Marshal(r.Params[n])
+            row = append(row, string(v))
+        }
+        for _, n := range stats {
+            v := ""
+            if s, ok := r.Stats[n]; ok {
+                v = strconv.FormatInt(s, 10)
+            }
+            row = append(row, v)
+        }
+        w.Write(row)
+    }
+
+    w.Flush()
+    if err := w.Error(); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+func sweep() {
+    out := flag.String("out", "sweep", "Results directory")
+    parallel := flag.Int("parallel", 1, "Number of concurrent runs")
+    retry := flag.Bool("retry", false, "Rerun failed and timed out runs")
+    flag.Usage = usage
+    flag.Parse()
+
+    if flag.NArg() != 1 {
+        usage()
+        os.Exit(2)
+    }
+
+    var s Spec
+    if err := readJSON(flag.Arg(0), &s); err != nil {
+        log.Fatal(err)
+    }
+    if s.Ticks < 1 {
+        log.Fatal("Ticks must be at least 1")
+    }
+    if *parallel < 1 {
+        log.Fatal("parallel must be at least 1")
+    }
+
+    // The base experiment starts from the defaults of the experiment flags.
+    x := cmd.NewExperiment()
+    if len(s.Base) > 0 {
+        d := json.NewDecoder(bytes.NewReader(s.Base))
+        d.DisallowUnknownFields()
+        if err := d.Decode(x); err != nil {
+            log.Fatal(err)
+        }
+    }
+    base, err := json.Marshal(x)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    runs, err := expand(s, base)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Concurrent runs share the CPUs rather than each using all of them.
+    procs := runtime.NumCPU() / *parallel
+    if procs < 1 {
+        procs = 1
+    }
+
+    results := make([]Result, len(runs))
+    sem := make(chan struct{}, *parallel)
+    var wg sync.WaitGroup
+
+    for i, r := range runs {
+        dir := filepath.Join(*out, r.ID)
+        done, err := prepare(dir, r)
+        if err != nil {
+            log.Fatal(err)
+        }
+        if done {
+            var res Result
+            err := readJSON(filepath.Join(dir, "result.json"), &res)
+            if err == nil && (res.Status == statusOK || !*retry) {
+                results[i] = res
+                continue
+            }
+        }
+
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(i int, r Run, dir string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+
+            res := execute(dir, r, s.Ticks, time.Duration(s.Timeout),
+                procs)
+            if err := writeJSON(filepath.Join(dir, "result.json"), res); err != nil {
+                log.Println(err)
+            }
+            log.Printf("run %s: %s %s", r.ID, res.Status, res.Error)
+            results[i] = res
+        }(i, r, dir)
+    }
+    wg.Wait()
+
+    names := make([]string, 0, len(s.Parameters))
+    for n := range s.Parameters {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+    if err := writeSummary(filepath.Join(*out, "summary.csv"),
+        names, results); err != nil {
+        log.Fatal(err)
+    }
+}
+
+// work runs a single experiment until it reaches ticks.
+func work() {
+    ticks := flag.Int64("ticks", 0, "Number of ticks to run")
+    out := flag.String("out", ".", "Output directory")
+    x := cmd.NewExperiment()
+
+    env, dts := x.ParseAndRun()
+
+    stats := make(tp.Stats)
+    hist := tp.NewHistory(x.Output.HistoryInterval, x.Output.HistorySize, 4, 4)
+    for dt := range dts {
+        stats.Add(dt.Stats)
+        hist.Add(stats)
+        if stats["Ticks"] >= *ticks {
+            break
+        }
+    }
+    if stats["Ticks"] < *ticks {
+        log.Fatalf("run ended at tick %d", stats["Ticks"])
+    }
+
+    if err := cmd.WriteHistory(filepath.Join(*out, "history.csv"), hist); err != nil {
+        log.Fatal(err)
+    }
+    if err := writeJSON(filepath.Join(*out, "stats.json"), stats); err != nil {
+        log.Fatal(err)
+    }
+    // The effective experiment includes the seed chosen for random seeds.
+    if err := writeJSON(filepath.Join(*out, "effective.json"), x); err != nil {
+        log.Fatal(err)
+    }
+
+    // Stop waits for the env to wind down, dropping the deltas left unread.
+    env.Stop()
+}
+
+func main() {
+    if len(os.Args) > 1 && os.Args[1] == "worker" {
+        os.Args = append(os.Args[:1], os.Args[2:]...)
+        work()
+        return
+    }
+    sweep()
+}
@@ -0,0 +1,316 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package main
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+
+    "tidepool/cmd"
+    tp "tidepool/tidepool"
+)
+
+const help = "q quit  space pause  n step  arrows/hjkl move  " +
+    "i/I inflow  m/M mutation  v/V viable"
+
+// Lines below the grid used by the stats panel and inspector.
+const panelLines = 6
+
+type key int
+
+const (
+    keyUp key = iota + 256
+    keyDown
+    keyRight
+    keyLeft
+)
+
+type view struct {
+    env *tp.Env
+    cells []*tp.Cell
+    stats tp.Stats
+
+    // Error of the last change, shown in the panel.
+    message string
+
+    // Cursor and top left corner of the viewport in grid coordinates.
+    cx, cy int32
+    vx, vy int32
+
+    rows, cols int
+}
+
+func stty(args ...string) (string, error) {
+    c := exec.Command("stty", args...)
+    c.Stdin = os.Stdin
+    out, err := c.Output()
+    return strings.TrimSpace(string(out)), err
+}
+
+func (v *view) resize() {
+    s, err := stty("size")
+    if err != nil {
+        return
+    }
+    fmt.Sscan(s, &v.rows, &v.cols)
+}
+
+func readKeys(keys chan<- key) {
+    b := make([]byte, 8)
+    for {
+        n, err := os.Stdin.Read(b)
+        if err != nil {
+            close(keys)
+            return
+        }
+        if n >= 3 && b[0] == 0x1b && b[1] == '[' {
+            switch b[2] {
+            case 'A':
+                keys <- keyUp
+            case 'B':
+                keys <- keyDown
+            case 'C':
+                keys <- keyRight
+            case 'D':
+                keys <- keyLeft
+            }
+            continue
+        }
+        for _, c := range b[:n] {
+            keys <- key(c)
+        }
+    }
+}
+
+func (v *view) apply(dt *tp.Delta) {
+    for _, c := range dt.Cells {
+        v.cells[c.Idx] = c
+    }
+    v.stats.Add(dt.Stats)
+}
+
+func (v *view) move(dx, dy int32) {
+    w, h := v.env.Width, v.env.Height
+    v.cx = (v.cx + dx + w) % w
+    v.cy = (v.cy + dy + h) % h
+}
+
+func (v *view) control(k key) bool {
+    config := v.env.GetConfig()
+    rng, _ := v.env.GetRNG().(tp.DefaultRNG)
+    setConfig := func() {
+        if err := v.env.SetConfig(config); err != nil {
+            v.message = err.Error()
+        }
+    }
+    setRNG := func() {
+        if err := v.env.SetRNG(rng); err != nil {
+            v.message = err.Error()
+        }
+    }
+    v.message = ""
+
+    switch k {
+    case 'q', 3:
+        return false
+    case ' ':
+        if v.env.Paused() {
+            v.env.Resume()
+        } else {
+            v.env.Pause()
+        }
+    case 'n':
+        v.env.Step(1)
+    case keyUp, 'k':
+        v.move(0, -1)
+    case keyDown, 'j':
+        v.move(0, 1)
+    case keyLeft, 'h':
+        v.move(-1, 0)
+    case keyRight, 'l':
+        v.move(1, 0)
+    case 'i':
+        config.InflowFrequency--
+        setConfig()
+    case 'I':
+        config.InflowFrequency++
+        setConfig()
+    case 'v':
+        config.ViableCellGeneration--
+        setConfig()
+    case 'V':
+        config.ViableCellGeneration++
+        setConfig()
+    case 'm':
+        rng.MutationRate /= 2
+        setRNG()
+    case 'M':
+        rng.MutationRate *= 2
+        setRNG()
+    }
+    return true
+}
+
+func colour(c *tp.Cell, config tp.Config) (uint8, uint8, uint8) {
+    if c.Energy == 0 || c.Generation < config.ViableCellGeneration {
+        return 0, 0, 0
+    }
+    k := uint32(c.Genome.Hash()) & 0xffffff
+    return uint8(k >> 16), uint8(k >> 8), uint8(k)
+}
+
+// render draws two grid rows per terminal line using half blocks, followed
+// by the stats panel and the cell under the cursor.
+func (v *view) render() []byte {
+    config := v.env.GetConfig()
+    rows := int32(v.rows - panelLines) * 2
+    cols := int32(v.cols)
+    if rows > v.env.Height {
+        rows = v.env.Height
+    }
+    if cols > v.env.Width {
+        cols = v.env.Width
+    }
+    rows -= rows % 2
+
+    // Keep the cursor in the viewport.
+    if v.cx < v.vx {
+        v.vx = v.cx
+    } else if v.cx >= v.vx + cols {
+        v.vx = v.cx - cols + 1
+    }
+    if v.cy < v.vy {
+        v.vy = v.cy
+    } else if v.cy >= v.vy + rows {
+        v.vy = v.cy - rows + 1
+    }
+
+    rgb := func(x, y int32) (uint8, uint8, uint8) {
+        if x == v.cx && y == v.cy {
+            return 255, 255, 255
+        }
+        return colour(v.cells[y * v.env.Width + x], config)
+    }
+
+    var b bytes.Buffer
+    b.WriteString("\x1b[H")
+    for y := v.vy; y < v.vy + rows; y += 2 {
+        for x := v.vx; x < v.vx + cols; x++ {
+            r, g, bl := rgb(x, y)
+            fmt.Fprintf(&b, "\x1b[38;2;%d;%d;%dm", r, g, bl)
+            if y + 1 < v.env.Height {
+                r, g, bl = rgb(x, y + 1)
+            } else {
+                r, g, bl = 0, 0, 0
+            }
+            fmt.Fprintf(&b, "\x1b[48;2;%d;%d;%dm▀", r, g, bl)
+        }
+        b.WriteString("\x1b[0m\x1b[K\r\n")
+    }
+
+    state := "running"
+    if v.env.Paused() {
+        state = "paused"
+    }
+    rng, _ := v.env.GetRNG().(tp.DefaultRNG)
+    s := v.stats
+    line := func(format string, a ...interface{}) {
+        l := fmt.Sprintf(format, a...)
+        if len(l) > v.cols {
+            l = l[:v.cols]
+        }
+        b.WriteString(l)
+        b.WriteString("\x1b[K\r\n")
+    }
+
+    line("%s  tick %d  live %d  viable %d  inflow %d  viable gen %d  "+
+        "mutation %g", state, s["Ticks"], s["LiveCells"],
+        s["ViableLiveCells"], config.InflowFrequency,
+        config.ViableCellGeneration, rng.MutationRate)
+    line("reproductions %d  mutations %d  kills %d  shares %d  "+
+        "genomes %d  shannon %d", s["Reproductions"], s["Mutations"],
+        s["CellsKilled"], s["CellsShared"], s["DistinctGenomes"],
+        s["ShannonDiversityMilli"])
+
+    c := v.cells[v.cy * v.env.Width + v.cx]
+    line("(%d,%d) id %d  origin %d  parent %d  gen %d  energy %d",
+        v.cx, v.cy, c.ID, c.Origin, c.Parent, c.Generation, c.Energy)
+    line("%s", strings.TrimRight(c.Genome.String(), "."))
+    line("%s", v.message)
+    // The last line has no newline, which would scroll the screen.
+    if len(help) > v.cols {
+        b.WriteString(help[:v.cols])
+    } else {
+        b.WriteString(help)
+    }
+    b.WriteString("\x1b[J")
+
+    return b.Bytes()
+}
+
+func main() {
+    refresh := flag.Duration("refresh", 200 * time.Millisecond,
+        "Screen refresh interval")
+    x := cmd.NewExperiment()
+
+    env, dts := x.ParseAndRun()
+    cells, stats := cmd.Snapshot(env, dts)
+    v := &view{
+        env: env,
+        cells: cells,
+        stats: stats,
+        rows: 24,
+        cols: 80,
+    }
+    if v.cells == nil {
+        log.Fatal("env stopped before start")
+    }
+
+    saved, err := stty("-g")
+    if err != nil {
+        log.Fatal("stdin is not a terminal")
+    }
+    if _, err := stty("raw", "-echo"); err != nil {
+        log.Fatal(err)
+    }
+    os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+    defer func() {
+        os.Stdout.WriteString("\x1b[0m\x1b[?25h\x1b[?1049l")
+        stty(saved)
+    }()
+
+    v.resize()
+    keys := make(chan key)
+    go readKeys(keys)
+
+    redraw := time.NewTicker(*refresh)
+    defer redraw.Stop()
+    resize := time.NewTicker(time.Second)
+    defer resize.Stop()
+
+    for {
+        select {
+        case k, ok := <-keys:
+            if !ok || !v.control(k) {
+                env.Stop()
+                return
+            }
+            os.Stdout.Write(v.render())
+        case dt, ok := <-dts:
+            if !ok {
+                return
+            }
+            v.apply(dt)
+        case <-redraw.C:
+            os.Stdout.Write(v.render())
+        case <-resize.C:
+            v.resize()
+        }
+    }
+}
@@ -3,59 +3,246 @@
 package main
 
 import (
+    "bytes"
+    "context"
+    "embed"
+    "encoding/json"
+    "errors"
     "flag"
+    "io/fs"
     "log"
     "net/http"
-    _ "net/http/pprof"
+    "net/http/pprof"
+    "os"
+    "os/signal"
     "runtime"
+    "strings"
+    "syscall"
     "text/template"
     "time"
 
     "tidepool/cmd"
+    "tidepool/metrics"
+    tp "tidepool/tidepool"
     "tidepool/web"
 )
 
+// The templates and static assets are embedded so the binary can be run from
+// any directory; the -index and -static flags override them.
+//go:embed index.html sims.html static
+var assets embed.FS
+
 type Index struct {
     Host string
     Scale int
 }
 
-func init() {
+// handlePprof serves the profiles of net/http/pprof to operators only.
+func handlePprof(mux *http.ServeMux, opts *web.Options) {
     runtime.SetBlockProfileRate(1)
     runtime.SetMutexProfileFraction(1)
+
+    mux.Handle("/debug/pprof/", opts.Require(web.RoleOperator,
+        http.HandlerFunc(pprof.Index)))
+    mux.Handle("/debug/pprof/cmdline", opts.Require(web.RoleOperator,
+        http.HandlerFunc(pprof.Cmdline)))
+    mux.Handle("/debug/pprof/profile", opts.Require(web.RoleOperator,
+        http.HandlerFunc(pprof.Profile)))
+    mux.Handle("/debug/pprof/symbol", opts.Require(web.RoleOperator,
+        http.HandlerFunc(pprof.Symbol)))
+    mux.Handle("/debug/pprof/trace", opts.Require(web.RoleOperator,
+        http.HandlerFunc(pprof.Trace)))
 }
 
 func main() {
     update := flag.Duration("update", time.Second, "Delta update frequency")
     addr := flag.String("addr", ":3000", "http service address")
-    index := flag.String("index", "index.html", "Path to html index file")
-    static := flag.String("static", "static", "Path to static directory")
+    index := flag.String("index", "",
+        "Path to html index file (default embedded)")
+    static := flag.String("static", "",
+        "Path to static directory (default embedded)")
     scale := flag.Int("scale", 1, "Scale of cell visualization")
+    queueSize := flag.Int("queue", web.DefaultOptions.QueueSize,
+        "Messages queued per websocket client")
+    slowClient := flag.String("slow-client", "resync",
+        "Policy for clients with a full queue (resync, drop or disconnect)")
+    writeTimeout := flag.Duration("write-timeout",
+        web.DefaultOptions.WriteTimeout, "Websocket write timeout")
+    tokens := flag.String("tokens", "",
+        "File of \"token role\" lines required to access the server " +
+        "(roles: viewer, operator)")
+    origins := flag.String("origins", "",
+        "Comma separated origins permitted to open websockets, or * for any " +
+        "(default same host)")
+    openOperator := flag.Bool("open-operator", false,
+        "Permit every client to control the env when -tokens is not given")
+    enablePprof := flag.Bool("pprof", false,
+        "Serve profiles under /debug/pprof to operators")
 
-    env, dts := cmd.ParseAndRun()
-    defer env.Stop()
+    name := flag.String("name", "default",
+        "Name of the simulation started from the command line, which is " +
+        "also served at the root")
+    maxSims := flag.Int("max-sims", 8,
+        "Maximum number of simulations (0 is unlimited)")
 
-    conn := web.NewConn(env, dts, time.Tick(*update))
-    defer conn.Close()
+    x := cmd.NewExperiment()
+    env, dts := x.ParseAndRun()
 
-    http.HandleFunc("/ws", conn.WebsocketHandler)
-    http.HandleFunc("/env", conn.EnvHandler)
+    js, err := json.Marshal(x)
+    if err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("experiment: %s", js)
 
-    indexTemp := template.Must(template.ParseFiles(*index))
+    opts := web.DefaultOptions
+    opts.QueueSize = *queueSize
+    opts.WriteTimeout = *writeTimeout
+    policy, err := web.ParseSlowClientPolicy(*slowClient)
+    if err != nil {
+        log.Fatal(err)
+    }
+    opts.SlowClient = policy
+    if *origins != "" {
+        opts.Origins = strings.Split(*origins, ",")
+    }
 
-    http.Handle("/static/", http.StripPrefix("/static/",
-        http.FileServer(http.Dir(*static))))
+    var auth *web.Auth
+    if *tokens != "" {
+        if auth, err = web.LoadAuth(*tokens); err != nil {
+            log.Fatal(err)
+        }
+        opts.Auth = auth
+    } else if *openOperator {
+        opts.Role = web.RoleOperator
+    }
+
+    var indexTemp *template.Template
+    if *index != "" {
+        indexTemp = template.Must(template.ParseFiles(*index))
+    } else {
+        indexTemp = template.Must(template.ParseFS(assets, "index.html"))
+    }
+    simsTemp := template.Must(template.ParseFS(assets, "sims.html"))
 
-    http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        indexTemp.Execute(w, Index{
-            Host: r.Host,
-            Scale: *scale,
+    // Simulations created over the API start from the experiment given on
+    // the command line, without its files.
+    base := x.Base()
+    factory := func(spec json.RawMessage) (web.SimParams, error) {
+        nx := base.Base()
+        if len(spec) > 0 {
+            if err := nx.Decode(bytes.NewReader(spec)); err != nil {
+                return web.SimParams{}, err
+            }
+        }
+        if nx.Replay != "" || nx.Output.Record != "" || nx.Output.History != "" {
+            return web.SimParams{}, errors.New(
+                "simulations created over the API may not use files")
+        }
+        if err := nx.Validate(); err != nil {
+            return web.SimParams{}, err
+        }
+        env, dts, err := nx.Run()
+        if err != nil {
+            return web.SimParams{}, err
+        }
+        return web.SimParams{
+            Env: env,
+            Deltas: dts,
+            History: tp.NewHistory(nx.Output.HistoryInterval,
+                nx.Output.HistorySize, 4, 4),
+            Spec: nx,
+        }, nil
+    }
+
+    routes := func(sim *web.Sim, mux *http.ServeMux) {
+        mux.Handle("/metrics",
+            metrics.NewExporter(sim.Env, sim.Conn.Stats, sim.Conn.Clients))
+        mux.HandleFunc("/experiment", func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(sim.Spec)
+        })
+        mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+            indexTemp.Execute(w, Index{
+                Host: r.Host + web.SimPrefix + sim.Name,
+                Scale: *scale,
+            })
         })
-    })
+    }
+
+    sims := web.NewSims(factory, *update, *maxSims, opts, routes)
+
+    hist := tp.NewHistory(x.Output.HistoryInterval, x.Output.HistorySize, 4, 4)
+    if _, err := sims.Add(*name, web.SimParams{
+        Env: env,
+        Deltas: dts,
+        History: hist,
+        Spec: x,
+    }); err != nil {
+        log.Fatal(err)
+    }
+
+    // Every route requires a viewer token when authentication is enabled;
+    // handlers that change the env check for an operator themselves.
+    mux := http.NewServeMux()
+    handle := func(pattern string, h http.Handler) {
+        mux.Handle(pattern, opts.Require(web.RoleViewer, h))
+    }
+
+    handle(web.SimPrefix, http.HandlerFunc(sims.SimHandler))
+    handle(web.SimsAPIPrefix, http.HandlerFunc(sims.APIHandler))
+    handle(web.SimsAPIPrefix + "/", http.HandlerFunc(sims.APIHandler))
+    handle("/sims", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        simsTemp.Execute(w, sims.List())
+    }))
+    if *enablePprof {
+        handlePprof(mux, &opts)
+    }
+
+    var staticFS http.FileSystem = http.Dir(*static)
+    if *static == "" {
+        sub, err := fs.Sub(assets, "static")
+        if err != nil {
+            log.Fatal(err)
+        }
+        staticFS = http.FS(sub)
+    }
+    handle("/static/", http.StripPrefix("/static/",
+        http.FileServer(staticFS)))
+
+    // Other paths are served by the simulation started from the command line
+    // as they were before there could be several.
+    handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if sims.Get(*name) == nil {
+            http.Redirect(w, r, "/sims", http.StatusFound)
+            return
+        }
+        r2 := r.Clone(r.Context())
+        r2.URL.Path = web.SimPrefix + *name + r.URL.Path
+        r2.URL.RawPath = ""
+        sims.SimHandler(w, r2)
+    }))
 
-    go conn.Run()
+    srv := &http.Server{Addr: *addr, Handler: mux}
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+    shutdown := make(chan struct{})
+    go func() {
+        defer close(shutdown)
+        log.Printf("received %s, shutting down", <-sig)
+        signal.Stop(sig)
+        // Stopping the simulations ends the websocket and SSE streams so
+        // that the server can shut down without waiting for them.
+        sims.Close()
+        ctx, cancel := context.WithTimeout(context.Background(),
+            *writeTimeout)
+        defer cancel()
+        if err := srv.Shutdown(ctx); err != nil {
+            log.Println(err)
+        }
+    }()
 
-    if err := http.ListenAndServe(*addr, nil); err != nil {
+    if err := srv.ListenAndServe(); err != http.ErrServerClosed {
         log.Fatal(err)
     }
+    <-shutdown
 }
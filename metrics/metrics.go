@@ -0,0 +1,173 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package metrics
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+
+    tp "tidepool/tidepool"
+)
+
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+const prefix = "tidepool_"
+
+// Exporter publishes Env metrics and accumulated Stats in the OpenMetrics
+// text format.
+type Exporter struct {
+    env *tp.Env
+    stats func() tp.Stats
+    clients func() int
+
+    mutex sync.Mutex
+    last tp.Metrics
+    lastTime time.Time
+}
+
+// NewExporter returns an Exporter for e. stats returns the accumulated
+// Stats of the run; clients, if not nil, returns the number of connected
+// clients.
+func NewExporter(e *tp.Env, stats func() tp.Stats,
+    clients func() int) *Exporter {
+    return &Exporter{
+        env: e,
+        stats: stats,
+        clients: clients,
+        lastTime: time.Now(),
+    }
+}
+
+// metricName converts a CamelCase stat name to a snake_case metric name.
+func metricName(name string) string {
+    var b strings.Builder
+    b.WriteString(prefix)
+    for i, r := range name {
+        if unicode.IsUpper(r) {
+            if i > 0 {
+                b.WriteRune('_')
+            }
+            r = unicode.ToLower(r)
+        }
+        b.WriteRune(r)
+    }
+    return b.String()
+}
+
+func writeMetric(w io.Writer, name, kind, help string, v interface{}) {
+    fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+    if help != "" {
+        fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+    }
+    if kind == "counter" {
+        name += "_total"
+    }
+    fmt.Fprintf(w, "%s %v\n", name, v)
+}
+
+// rates returns ticks per second and process utilisation since the previous
+// call.
+func (x *Exporter) rates(m tp.Metrics) (float64, float64) {
+    x.mutex.Lock()
+    defer x.mutex.Unlock()
+
+    now := time.Now()
+    elapsed := now.Sub(x.lastTime)
+    if elapsed <= 0 {
+        return 0, 0
+    }
+
+    tps := float64(m.Ticks - x.last.Ticks) / elapsed.Seconds()
+
+    var util float64
+    if m.Processes > 0 {
+        busy := m.BusyTime - x.last.BusyTime
+        util = float64(busy) / (float64(elapsed) * float64(m.Processes))
+    }
+
+    x.last = m
+    x.lastTime = now
+
+    return tps, util
+}
+
+func (x *Exporter) WriteTo(w io.Writer) (int64, error) {
+    bw := bufio.NewWriter(w)
+    cw := &countWriter{w: bw}
+
+    m := x.env.GetMetrics()
+    tps, util := x.rates(m)
+
+    writeMetric(cw, prefix + "ticks", "counter",
+        "Environment clock ticks.", m.Ticks)
+    writeMetric(cw, prefix + "ticks_per_second", "gauge",
+        "Ticks per second since the previous scrape.", tps)
+    writeMetric(cw, prefix + "processes", "gauge",
+        "Cell execution processes.", m.Processes)
+    writeMetric(cw, prefix + "busy_processes", "gauge",
+        "Processes currently handling a tick.", m.BusyProcesses)
+    writeMetric(cw, prefix + "process_busy_seconds", "counter",
+        "Cumulative time spent by processes handling ticks.",
+        m.BusyTime.Seconds())
+    writeMetric(cw, prefix + "process_utilisation", "gauge",
+        "Fraction of process time spent busy since the previous scrape.",
+        util)
+    writeMetric(cw, prefix + "delta_queue_depth", "gauge",
+        "Deltas waiting to be applied to the grid.", m.QueuedDeltas)
+    if x.clients != nil {
+        writeMetric(cw, prefix + "clients", "gauge",
+            "Connected clients.", x.clients())
+    }
+
+    stats := x.stats()
+    names := make([]string, 0, len(stats))
+    for n := range stats {
+        if n != "Ticks" {
+            names = append(names, n)
+        }
+    }
+    sort.Strings(names)
+
+    for _, n := range names {
+        kind := "counter"
+        if tp.IsGauge(n) {
+            kind = "gauge"
+        }
+        writeMetric(cw, metricName(n), kind, "", stats[n])
+    }
+
+    fmt.Fprintln(cw, "# EOF")
+
+    if err := bw.Flush(); err != nil {
+        return cw.n, err
+    }
+    return cw.n, cw.err
+}
+
+func (x *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", ContentType)
+    x.WriteTo(w)
+}
+
+type countWriter struct {
+    w io.Writer
+    n int64
+    err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+    if cw.err != nil {
+        return 0, cw.err
+    }
+    n, err := cw.w.Write(p)
+    cw.n += int64(n)
+    cw.err = err
+    return n, err
+}
@@ -0,0 +1,62 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package metrics
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    tp "tidepool/tidepool"
+)
+
+func TestExporterScrape(t *testing.T) {
+    env, err := tp.NewEnv(8, 8, 16, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stats := tp.Stats{
+        "Ticks": 10,
+        "LiveCells": 3,
+        "Reproductions": 7,
+    }
+    x := NewExporter(env, func() tp.Stats { return stats },
+        func() int { return 2 })
+
+    srv := httptest.NewServer(x)
+    defer srv.Close()
+
+    resp, err := http.Get(srv.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+        t.Fatalf("unexpected content type: %s", ct)
+    }
+
+    b, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body := string(b)
+
+    for _, line := range []string{
+        "# TYPE tidepool_live_cells gauge",
+        "tidepool_live_cells 3",
+        "# TYPE tidepool_reproductions counter",
+        "tidepool_reproductions_total 7",
+        "tidepool_clients 2",
+        "tidepool_delta_queue_depth 0",
+    } {
+        if !strings.Contains(body, line + "\n") {
+            t.Errorf("missing %q in:\n%s", line, body)
+        }
+    }
+    if !strings.HasSuffix(body, "# EOF\n") {
+        t.Errorf("missing EOF marker")
+    }
+}
@@ -0,0 +1,123 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "math"
+    "math/rand"
+
+    "tidepool/tidepool/gene"
+)
+
+const diversityPairs = 256
+
+// Diversity summarizes the genetic diversity of viable live cells.
+type Diversity struct {
+    Cells int64
+    DistinctGenomes int64
+    DistinctOrigins int64
+    Shannon float64
+    Dominant gene.Genome
+    DominantAbundance int64
+    MeanHammingDistance float64
+    MeanEffectiveLength float64
+}
+
+func (c *Cell) effectiveLength() int {
+    for i := genomeStartIdx; i < len(c.Genome); i++ {
+        if c.Genome[i] == gene.STOP {
+            return i - genomeStartIdx
+        }
+    }
+    return len(c.Genome) - genomeStartIdx
+}
+
+func hammingDistance(a, b gene.Genome) int {
+    d := 0
+    for i := range a {
+        if i >= len(b) || a[i] != b[i] {
+            d++
+        }
+    }
+    return d
+}
+
+// ComputeDiversity measures the diversity of the viable live cells in cs,
+// estimating the mean Hamming distance from pairs random pairs.
+func ComputeDiversity(cs []*Cell, config Config, r *rand.Rand,
+    pairs int) Diversity {
+    var d Diversity
+
+    viable := make([]*Cell, 0)
+    genomes := make(map[uint64]int64)
+    dominant := make(map[uint64]*Cell)
+    origins := make(map[int64]bool)
+    var length int
+
+    for _, c := range cs {
+        if !c.live() || !c.viable(config) {
+            continue
+        }
+        viable = append(viable, c)
+
+        h := c.Genome.Hash()
+        genomes[h]++
+        if _, ok := dominant[h]; !ok {
+            dominant[h] = c
+        }
+        origins[c.Origin] = true
+        length += c.effectiveLength()
+    }
+
+    d.Cells = int64(len(viable))
+    if d.Cells == 0 {
+        return d
+    }
+
+    d.DistinctGenomes = int64(len(genomes))
+    d.DistinctOrigins = int64(len(origins))
+    d.MeanEffectiveLength = float64(length) / float64(d.Cells)
+
+    var domHash uint64
+    for h, n := range genomes {
+        p := float64(n) / float64(d.Cells)
+        d.Shannon -= p * math.Log(p)
+        if n > d.DominantAbundance || (n == d.DominantAbundance && h < domHash) {
+            d.DominantAbundance = n
+            domHash = h
+        }
+    }
+    d.Dominant = dominant[domHash].Genome
+
+    if len(viable) > 1 && pairs > 0 {
+        var dist int
+        for i := 0; i < pairs; i++ {
+            a := r.Intn(len(viable))
+            b := r.Intn(len(viable) - 1)
+            if b >= a {
+                b++
+            }
+            dist += hammingDistance(viable[a].Genome, viable[b].Genome)
+        }
+        d.MeanHammingDistance = float64(dist) / float64(pairs)
+    }
+
+    return d
+}
+
+func (d Diversity) Stats() Stats {
+    var hash int64
+    if d.Dominant != nil {
+        hash = int64(d.Dominant.Hash())
+    }
+
+    return Stats{
+        "DistinctGenomes": d.DistinctGenomes,
+        "DistinctOrigins": d.DistinctOrigins,
+        "ShannonDiversityMilli": int64(math.Round(d.Shannon * 1000)),
+        "DominantGenomeHash": hash,
+        "DominantGenomeAbundance": d.DominantAbundance,
+        "MeanHammingDistance": int64(math.Round(d.MeanHammingDistance)),
+        "MeanEffectiveLength": int64(math.Round(d.MeanEffectiveLength)),
+    }
+}
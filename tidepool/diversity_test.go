@@ -0,0 +1,92 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "context"
+    "math"
+    "math/rand"
+    "sync"
+    "testing"
+    "time"
+
+    "tidepool/tidepool/gene"
+)
+
+func TestComputeDiversity(t *testing.T) {
+    config := defaultConfig
+    cs := make([]*Cell, 4)
+    for i := range cs {
+        cs[i] = newCell(int32(i), int32(i), 0, 4)
+        cs[i].Energy = 1
+        cs[i].Generation = config.ViableCellGeneration
+        cs[i].Origin = int64(i % 2)
+    }
+    cs[0].Genome = gene.Genome{gene.ZERO, gene.INC, gene.STOP, gene.STOP}
+    cs[1].Genome = gene.Genome{gene.ZERO, gene.INC, gene.STOP, gene.STOP}
+    cs[2].Genome = gene.Genome{gene.ZERO, gene.INC, gene.INC, gene.STOP}
+    // Dead cells are ignored.
+    cs[3].Energy = 0
+
+    d := ComputeDiversity(cs, config, rand.New(rand.NewSource(1)), 16)
+
+    if d.Cells != 3 || d.DistinctGenomes != 2 || d.DistinctOrigins != 2 {
+        t.Fatalf("unexpected counts: %+v", d)
+    }
+    if d.DominantAbundance != 2 || d.Dominant.String() != "0+.." {
+        t.Fatalf("unexpected dominant genome: %+v", d)
+    }
+    shannon := -(2.0 / 3 * math.Log(2.0 / 3) + 1.0 / 3 * math.Log(1.0 / 3))
+    if math.Abs(d.Shannon - shannon) > 1e-9 {
+        t.Fatalf("expected shannon %f, got %f", shannon, d.Shannon)
+    }
+    if d.MeanEffectiveLength != 4.0 / 3 {
+        t.Fatalf("unexpected effective length: %f", d.MeanEffectiveLength)
+    }
+}
+
+func TestDiversityDoesNotBlockUpdates(t *testing.T) {
+    entered := make(chan struct{})
+    release := make(chan struct{})
+    var once sync.Once
+    computeDiversity = func(cs []*Cell, config Config, r *rand.Rand,
+        pairs int) Diversity {
+        once.Do(func() { close(entered) })
+        <-release
+        return ComputeDiversity(cs, config, r, pairs)
+    }
+    defer func() { computeDiversity = ComputeDiversity }()
+
+    env, err := NewEnv(256, 256, 64, 4096, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    config := env.GetConfig()
+    config.DiversityInterval = 1
+    if err := env.SetConfig(config); err != nil {
+        t.Fatal(err)
+    }
+
+    dts := make(chan *Delta)
+    go env.Run(2, 100 * time.Microsecond, dts)
+    go func() {
+        for range dts {
+        }
+    }()
+    defer env.Stop()
+
+    select {
+    case <-entered:
+    case <-time.After(5 * time.Second):
+        t.Fatal("diversity not computed")
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    err = env.Update(ctx, func(g MutableGrid) error {
+        return g.SetEnergy(0, 0, 100)
+    })
+    close(release)
+    if err != nil {
+        t.Fatalf("update blocked by diversity: %v", err)
+    }
+}
@@ -5,10 +5,13 @@ package tidepool
 import (
     "context"
     "errors"
+    "fmt"
     "math/rand"
     "sync"
     "sync/atomic"
     "time"
+
+    "tidepool/tidepool/gene"
 )
 
 type Env struct {
@@ -18,35 +21,96 @@ type Env struct {
     Seed int64
 
     initPop int32
+    // ID of the last cell placed or born; IDs of cells placed with PlaceCell
+    // before Run come first.
+    lastCellID int64
 
     config atomic.Value
     rng atomic.Value
 
     running uint32
+    replaying uint32
+    paused uint32
+    // Ticks to run while paused.
+    steps int64
+
+    ticks int64
+    processN int32
+    busyProcesses int32
+    busyNanos int64
+    queuedDeltas int32
 
     cells []*Cell
     cellsBuf []*Cell
 
     rand *rand.Rand
-
-    nextCellID chan int64
+    // Samples cells for diversity stats apart from rand, so that how often
+    // they are computed does not change the run.
+    diversityRand *rand.Rand
 
     context context.Context
-    Stop context.CancelFunc
+    cancel context.CancelFunc
+    // Set when Run or Replay starts; done is closed when it has returned.
+    started uint32
+    startMutex sync.RWMutex
+    done chan struct{}
+
+    // Requests served between ticks.
+    views chan func([]*Cell)
+    updates chan *update
+}
 
-    WithCells chan func([]*Cell)
+// ErrStopped is returned for requests to an env that has been stopped.
+var ErrStopped = errors.New("Env is stopped")
+
+type Metrics struct {
+    Ticks int64
+    Processes int32
+    BusyProcesses int32
+    // Cumulative time spent by processes handling ticks.
+    BusyTime time.Duration
+    // Deltas produced by processes but not yet applied to the grid.
+    QueuedDeltas int32
 }
 
 type Config struct {
     InflowFrequency int64
     ViableCellGeneration int64
     FailedKillPenalty int64
+    // Ticks between diversity measurements; 0 disables them.
+    DiversityInterval int64
 }
 
 var defaultConfig = Config{
     InflowFrequency: 10,
     ViableCellGeneration: 2,
     FailedKillPenalty: 3,
+    DiversityInterval: 1000,
+}
+
+// DefaultConfig returns the Config used by new environments.
+func DefaultConfig() Config {
+    return defaultConfig
+}
+
+func (c Config) Validate() error {
+    if c.InflowFrequency < 1 {
+        return fmt.Errorf("InflowFrequency must be at least 1, got %d",
+            c.InflowFrequency)
+    }
+    if c.ViableCellGeneration < 0 {
+        return fmt.Errorf("ViableCellGeneration must not be negative, got %d",
+            c.ViableCellGeneration)
+    }
+    if c.FailedKillPenalty < 1 {
+        return fmt.Errorf("FailedKillPenalty must be at least 1, got %d",
+            c.FailedKillPenalty)
+    }
+    if c.DiversityInterval < 0 {
+        return fmt.Errorf("DiversityInterval must not be negative, got %d",
+            c.DiversityInterval)
+    }
+    return nil
 }
 
 func getIdx(x, y, width int32) int32 {
@@ -57,7 +121,19 @@ func getCoords(idx, width int32) (int32, int32) {
 	return idx % width, idx / width
 }
 
-func NewEnv(width, height, genomeSize, pop int32, seed int64) *Env {
+func NewEnv(width, height, genomeSize, pop int32, seed int64) (*Env, error) {
+    if width < 1 || height < 1 {
+        return nil, fmt.Errorf("invalid environment size: %dx%d", width, height)
+    }
+    if genomeSize <= genomeStartIdx {
+        return nil, fmt.Errorf("genome size must be greater than %d, got %d",
+            genomeStartIdx, genomeSize)
+    }
+    if pop < 0 || pop > width * height {
+        return nil, fmt.Errorf("initial population must be between 0 and %d, got %d",
+            width * height, pop)
+    }
+
     if seed < 1 {
         seed = time.Now().UnixNano()
     }
@@ -71,8 +147,10 @@ func NewEnv(width, height, genomeSize, pop int32, seed int64) *Env {
         cells: make([]*Cell, width * height),
         cellsBuf: make([]*Cell, width * height),
         rand: rand.New(rand.NewSource(seed)),
-        nextCellID: make(chan int64),
-        WithCells: make(chan func([]*Cell)),
+        diversityRand: rand.New(rand.NewSource(seed)),
+        done: make(chan struct{}),
+        views: make(chan func([]*Cell)),
+        updates: make(chan *update),
     }
 
     for i := range e.cells {
@@ -82,32 +160,200 @@ func NewEnv(width, height, genomeSize, pop int32, seed int64) *Env {
         e.cells[i] = newCell(idx, x, y, genomeSize)
     }
 
-    e.context, e.Stop = context.WithCancel(context.Background())
+    e.context, e.cancel = context.WithCancel(context.Background())
 
-    e.SetConfig(defaultConfig)
-    e.SetRNG(defaultRNG)
+    e.config.Store(defaultConfig)
+    e.rng.Store(rngValue{defaultRNG})
 
-    return e
+    return e, nil
 }
 
 func (e *Env) GetConfig() Config {
     return e.config.Load().(Config)
 }
 
-func (e *Env) SetConfig(c Config) {
+func (e *Env) SetConfig(c Config) error {
+    if err := c.Validate(); err != nil {
+        return err
+    }
     e.config.Store(c)
+    return nil
+}
+
+// rngValue is stored in the rng of an env so that its concrete type does not
+// change with the type of the RNG.
+type rngValue struct {
+    RNG
 }
 
 func (e *Env) GetRNG() RNG {
-    return e.rng.Load().(RNG)
+    return e.rng.Load().(rngValue).RNG
 }
 
-func (e *Env) SetRNG(r RNG) {
-    e.rng.Store(r)
+// SetRNG replaces the RNG of the env. If r has a Validate method, it must
+// return nil.
+func (e *Env) SetRNG(r RNG) error {
+    if r == nil {
+        return errors.New("RNG must not be nil")
+    }
+    if v, ok := r.(interface{ Validate() error }); ok {
+        if err := v.Validate(); err != nil {
+            return err
+        }
+    }
+    e.rng.Store(rngValue{r})
+    return nil
+}
+
+// PlaceCell puts a live cell with genome g at x, y. Genomes shorter than the
+// genome size of the env are padded with STOP. It must be called before Run.
+func (e *Env) PlaceCell(x, y int32, g gene.Genome, energy, generation int64) error {
+    if atomic.LoadUint32(&e.running) == 1 {
+        return errors.New("Env is running")
+    }
+    if x < 0 || x >= e.Width || y < 0 || y >= e.Height {
+        return fmt.Errorf("cell position %d,%d outside of grid", x, y)
+    }
+    if int32(len(g)) > e.GenomeSize {
+        return fmt.Errorf("genome of %d genes exceeds genome size %d",
+            len(g), e.GenomeSize)
+    }
+    if energy < 1 {
+        return fmt.Errorf("cell energy must be positive, got %d", energy)
+    }
+
+    c := e.cells[getIdx(x, y, e.Width)]
+    if !c.live() {
+        e.lastCellID++
+        c.ID = e.lastCellID
+        c.Origin = c.ID
+    }
+    c.Parent = 0
+    c.Generation = generation
+    c.Energy = energy
+    c.resetGenome()
+    copy(c.Genome, g)
+
+    return nil
+}
+
+// Inject puts a live cell with genome g at x, y of the running env. The cell
+// is delivered to consumers in a Delta like any other change, with the stats
+// Updates and Injections. It returns the ID of the new cell.
+func (e *Env) Inject(x, y int32, g gene.Genome, energy, generation int64) (int64, error) {
+    var id int64
+    err := e.update(context.Background(), Stats{"Injections": 1},
+        func(mg MutableGrid) error {
+            var err error
+            id, err = mg.Place(x, y, g, energy, generation)
+            return err
+        })
+    if err != nil {
+        return 0, err
+    }
+    return id, nil
+}
+
+// WithCells runs f on the grid of the running env between ticks and waits
+// for it to return. It returns ErrStopped if the env stops first. f must not
+// keep the grid or call Stop.
+//
+// Deprecated: f is given the live cells; use View or Update instead.
+func (e *Env) WithCells(f func([]*Cell)) error {
+    if e.context.Err() != nil {
+        return ErrStopped
+    }
+    err := e.View(e.context, func(g Grid) error {
+        f(g.(readGrid).g.cells)
+        return nil
+    })
+    if err == context.Canceled {
+        return ErrStopped
+    }
+    return err
+}
+
+// Stop stops the env and waits for Run or Replay to return, after which the
+// grid is no longer changed and the deltas channel is closed. Deltas in
+// flight when Stop is called are applied to the grid but not sent. Stop may
+// be called more than once and from any goroutine, including the one
+// receiving deltas.
+func (e *Env) Stop() {
+    e.cancel()
+    if atomic.LoadUint32(&e.started) == 1 {
+        <-e.done
+    }
+}
+
+// start marks the env as started, reporting false if it already was or has
+// been stopped.
+func (e *Env) start() bool {
+    e.startMutex.Lock()
+    defer e.startMutex.Unlock()
+    if !atomic.CompareAndSwapUint32(&e.started, 0, 1) {
+        return false
+    }
+    if e.context.Err() != nil {
+        close(e.done)
+        return false
+    }
+    atomic.StoreUint32(&e.running, 1)
+    return true
+}
+
+func (e *Env) finish() {
+    atomic.StoreUint32(&e.running, 0)
+    close(e.done)
+}
+
+// Pause stops the clock of the env until Resume is called. Step advances a
+// paused env by n ticks.
+func (e *Env) Pause() {
+    atomic.StoreUint32(&e.paused, 1)
+}
+
+func (e *Env) Resume() {
+    atomic.StoreInt64(&e.steps, 0)
+    atomic.StoreUint32(&e.paused, 0)
+}
+
+func (e *Env) Step(n int64) {
+    e.Pause()
+    atomic.AddInt64(&e.steps, n)
+}
+
+func (e *Env) Paused() bool {
+    return atomic.LoadUint32(&e.paused) == 1
+}
+
+// advance reports whether the clock should tick, taking a step if paused.
+func (e *Env) advance() bool {
+    if !e.Paused() {
+        return true
+    }
+    for {
+        s := atomic.LoadInt64(&e.steps)
+        if s <= 0 {
+            return false
+        }
+        if atomic.CompareAndSwapInt64(&e.steps, s, s - 1) {
+            return true
+        }
+    }
+}
+
+func (e *Env) GetMetrics() Metrics {
+    return Metrics{
+        Ticks: atomic.LoadInt64(&e.ticks),
+        Processes: atomic.LoadInt32(&e.processN),
+        BusyProcesses: atomic.LoadInt32(&e.busyProcesses),
+        BusyTime: time.Duration(atomic.LoadInt64(&e.busyNanos)),
+        QueuedDeltas: atomic.LoadInt32(&e.queuedDeltas),
+    }
 }
 
 func (e *Env) getNextCellID() int64 {
-    return <-e.nextCellID
+    return atomic.AddInt64(&e.lastCellID, 1)
 }
 
 func (e *Env) applyDelta(dt *Delta, exec Refs, live Refs) {
@@ -121,7 +367,10 @@ func (e *Env) applyDelta(dt *Delta, exec Refs, live Refs) {
     }
 
     for _, c := range dt.Neighborhood {
-        exec.dec(c)
+        // Injected deltas have no neighborhood.
+        if c != nil {
+            exec.dec(c)
+        }
     }
 
     var i int64
@@ -136,10 +385,16 @@ func (e *Env) applyDelta(dt *Delta, exec Refs, live Refs) {
     dt.Stats["LiveCells"] = int64(len(live))
 }
 
-func (e *Env) getNeighborhood(c *Cell) (nh Neighborhood) {
-	x, y := getCoords(c.Idx, e.Width)
+func (e *Env) getNeighborhood(c *Cell) Neighborhood {
+    return e.neighborhood(e.cells, c.Idx)
+}
+
+// neighborhood returns the neighborhood of the cell at idx in cs, which must
+// have the size of the grid.
+func (e *Env) neighborhood(cs []*Cell, idx int32) (nh Neighborhood) {
+	x, y := getCoords(idx, e.Width)
     // Center cell is at index 0.
-    nh[0] = e.cells[c.Idx]
+    nh[0] = cs[idx]
 	i := 1
 
 	for _, w := range [...]int32{e.Width - 1, 0, 1} {
@@ -147,7 +402,7 @@ func (e *Env) getNeighborhood(c *Cell) (nh Neighborhood) {
 			if w == 0 && h == 0 {
 				continue
 			}
-			nh[i] = e.cells[getIdx((x+w)%e.Width, (y+h)%e.Height, e.Width)]
+			nh[i] = cs[getIdx((x+w)%e.Width, (y+h)%e.Height, e.Width)]
 			i++
 		}
 	}
@@ -155,6 +410,9 @@ func (e *Env) getNeighborhood(c *Cell) (nh Neighborhood) {
 	return nh
 }
 
+// getRandomCell returns a random cell outside of the neighborhoods being
+// executed, or nil if there is none, which happens on grids not much larger
+// than the neighborhoods of all processes.
 func (e *Env) getRandomCell(exec Refs) *Cell {
     i := 0
     for _, c := range e.cells {
@@ -163,19 +421,26 @@ func (e *Env) getRandomCell(exec Refs) *Cell {
             i++
         }
     }
+    if i == 0 {
+        return nil
+    }
 
     return e.cellsBuf[e.rand.Intn(i)]
 }
 
-func (e *Env) getExecNeighborhood(exec Refs) Neighborhood {
-    nh := e.getNeighborhood(e.getRandomCell(exec))
+func (e *Env) getExecNeighborhood(exec Refs) (Neighborhood, bool) {
+    c := e.getRandomCell(exec)
+    if c == nil {
+        return Neighborhood{}, false
+    }
+    nh := e.getNeighborhood(c)
 
     for i, c := range nh {
         nh[i] = c.clone()
         exec.inc(c)
     }
 
-    return nh
+    return nh, true
 }
 
 func (e *Env) process(wg *sync.WaitGroup, exec <-chan int64, inflow <-chan int64,
@@ -185,119 +450,235 @@ func (e *Env) process(wg *sync.WaitGroup, exec <-chan int64, inflow <-chan int64
     ctx := newContext(e)
 
     handle := func (fn func(Neighborhood) *Delta, ticks int64) {
+        atomic.AddInt32(&e.busyProcesses, 1)
+        start := time.Now()
         dt := fn(<-execNeighborhoods)
         dt.Stats["Ticks"] = ticks
+        atomic.AddInt64(&e.busyNanos, int64(time.Since(start)))
+        atomic.AddInt32(&e.busyProcesses, -1)
+        atomic.AddInt32(&e.queuedDeltas, 1)
         dts <- dt
     }
 
+    // The clock closes exec and inflow when the env stops; the apply loop
+    // serves neighborhoods and receives deltas until every process returned.
     for {
         select {
-        case <-e.context.Done():
-            return
-        case ticks := <-inflow:
+        case ticks, ok := <-inflow:
+            if !ok {
+                return
+            }
             handle(ctx.seed, ticks)
-        case ticks := <-exec:
+        case ticks, ok := <-exec:
+            if !ok {
+                return
+            }
             handle(ctx.vm.exec, ticks)
         }
     }
 }
 
+// apply applies the deltas of the processes to the grid and sends them to
+// deltas until processes is closed. It also serves View and Update.
+// Once the env is stopped, deltas are still applied but no longer sent.
+func (e *Env) apply(processN int, execNeighborhoods chan<- Neighborhood,
+    dts <-chan *Delta, processes <-chan struct{}, deltas chan<- *Delta) {
+    execRefs := make(Refs)
+    // Cells placed before Run are live from the start.
+    liveRefs := make(Refs)
+    for _, c := range e.cells {
+        if c.live() {
+            liveRefs.inc(c)
+        }
+    }
+
+    // Diversity is computed by another goroutine on its own grid, which is
+    // sent the cells of applied deltas whenever it is ready for them.
+    grid := make([]*Cell, len(e.cells))
+    for i, c := range e.cells {
+        grid[i] = c.clone()
+    }
+    divIn := make(chan []*Cell)
+    divOut := make(chan Stats, 1)
+    go e.diversity(grid, divIn, divOut)
+    defer func() {
+        close(divIn)
+        for range divOut {
+        }
+    }()
+    var divCells []*Cell
+    var divStats Stats
+
+    send := func(dt *Delta) {
+        if e.context.Err() != nil {
+            return
+        }
+        select {
+        case deltas <- dt:
+        case <-e.context.Done():
+        }
+    }
+
+    // The next neighborhood to execute, if any. Neighborhoods are taken
+    // ahead of time so processes do not wait for them, and are held in the
+    // buffer of execNeighborhoods until a process takes them.
+    var next Neighborhood
+    hasNext := false
+
+    for {
+        if !hasNext {
+            next, hasNext = e.getExecNeighborhood(execRefs)
+        }
+        var nhs chan<- Neighborhood
+        if hasNext {
+            nhs = execNeighborhoods
+        }
+        var divSend chan<- []*Cell
+        if len(divCells) > 0 {
+            divSend = divIn
+        }
+
+        select {
+        case <-processes:
+            return
+        case nhs <- next:
+            hasNext = false
+        case divSend <- divCells:
+            divCells = nil
+        case divStats = <-divOut:
+        case f := <-e.views:
+            f(e.cells)
+        case u := <-e.updates:
+            if dt := u.run(e, e.cells); dt != nil {
+                e.applyDelta(dt, execRefs, liveRefs)
+                divCells = append(divCells, dt.Cells...)
+                send(dt)
+            }
+        case dt := <-dts:
+            atomic.AddInt32(&e.queuedDeltas, -1)
+            e.applyDelta(dt, execRefs, liveRefs)
+            divCells = append(divCells, dt.Cells...)
+            if divStats != nil {
+                dt.Stats.Add(divStats)
+                divStats = nil
+            }
+            send(dt)
+        }
+    }
+}
+
+// computeDiversity is replaced by tests.
+var computeDiversity = ComputeDiversity
+
+// diversity applies the cells received from cells to grid and computes the
+// diversity stats of grid every DiversityInterval ticks, sending them to
+// stats. Cells of deltas are not changed once sent, so grid may share them.
+// It closes stats when cells is closed.
+func (e *Env) diversity(grid []*Cell, cells <-chan []*Cell, stats chan<- Stats) {
+    defer close(stats)
+    var last int64
+    for cs := range cells {
+        for _, c := range cs {
+            grid[c.Idx] = c
+        }
+        config := e.GetConfig()
+        t := atomic.LoadInt64(&e.ticks)
+        if config.DiversityInterval <= 0 || t - last < config.DiversityInterval {
+            continue
+        }
+        last = t
+        d := computeDiversity(grid, config, e.diversityRand, diversityPairs)
+        select {
+        case stats <- d.Stats():
+        default:
+        }
+    }
+}
+
+// Run runs the env with processN processes and a clock ticking every tick
+// until Stop is called, sending every change to deltas. It closes deltas and
+// returns once all of its goroutines have returned.
 func (e *Env) Run(processN int, tick time.Duration, deltas chan<- *Delta) {
+    defer close(deltas)
+    if !e.start() {
+        return
+    }
+    defer e.finish()
+
     exec := make(chan int64)
     inflow := make(chan int64)
     execNeighborhoods := make(chan Neighborhood, processN)
     dts := make(chan *Delta, processN)
+    processes := make(chan struct{})
+    applied := make(chan struct{})
 
-    defer close(exec)
-    defer close(inflow)
+    atomic.StoreInt32(&e.processN, int32(processN))
 
     var wg sync.WaitGroup
     wg.Add(processN)
-    defer wg.Wait()
-
     for i := 0; i < processN; i++ {
         go e.process(&wg, exec, inflow, execNeighborhoods, dts)
     }
 
     go func() {
-        defer close(dts)
-        defer close(execNeighborhoods)
-        defer close(deltas)
-        defer close(e.WithCells)
-
-        execRefs := make(Refs)
-        liveRefs := make(Refs)
-
-        for {
-            select {
-                case <-e.context.Done():
-                    return
-                case f := <-e.WithCells:
-                    f(e.cells)
-                case dt := <-dts:
-                    e.applyDelta(dt, execRefs, liveRefs)
-                    deltas <- dt
-                default:
-                    if len(execNeighborhoods) < processN {
-                        nh := e.getExecNeighborhood(execRefs)
-                        go func() {
-                            execNeighborhoods <- nh
-                        }()
-                    }
-            }
-        }
+        defer close(applied)
+        e.apply(processN, execNeighborhoods, dts, processes, deltas)
     }()
 
-    go func() {
-        defer close(e.nextCellID)
-        var id int64 = 1
-        for {
-            select {
-            case <-e.context.Done():
-                return
-            default:
-                e.nextCellID <- id
-                id++
-            }
-        }
-    }()
+    e.clock(tick, exec, inflow)
 
+    close(exec)
+    close(inflow)
+    wg.Wait()
+    close(processes)
+    <-applied
+}
+
+// clock sends ticks to the processes until the env is stopped.
+func (e *Env) clock(tick time.Duration, exec, inflow chan<- int64) {
     var ticks int64 = 0
 
+    send := func(ch chan<- int64) bool {
+        select {
+        case ch <- ticks:
+            return true
+        case <-e.context.Done():
+            return false
+        }
+    }
+
     inflowTick := e.GetConfig().InflowFrequency
-    sendInflow := func () {
-        inflow <- ticks
+    sendInflow := func () bool {
         inflowTick = e.GetConfig().InflowFrequency
+        return send(inflow)
     }
 
     ticker := time.NewTicker(tick)
     defer ticker.Stop()
 
-    atomic.StoreUint32(&e.running, 1)
-
     for {
         select {
         case <-e.context.Done():
-            atomic.StoreUint32(&e.running, 0)
             return
         case <-ticker.C:
+            if !e.advance() {
+                continue
+            }
             ticks++
+            atomic.StoreInt64(&e.ticks, ticks)
             if e.initPop > 0 {
-                sendInflow()
+                if !sendInflow() {
+                    return
+                }
                 e.initPop--
             }
             inflowTick--
-            if inflowTick == 0 {
-                sendInflow()
+            if inflowTick == 0 && !sendInflow() {
+                return
+            }
+            if !send(exec) {
+                return
             }
-            exec <- ticks
         }
     }
 }
-
-func (e *Env) GetCells() ([]*Cell, error) {
-    if atomic.LoadUint32(&e.running) == 1 {
-        return nil, errors.New("Env is running")
-    }
-    return e.cells, nil
-}
@@ -4,12 +4,14 @@ package tidepool
 
 import (
     "encoding/json"
+    "sync"
     "testing"
-)
+    "time"
 
-func BenchmarkJSONMarshalCells(b *testing.B) {
-    b.ReportAllocs()
+    "tidepool/tidepool/gene"
+)
 
+func newBenchDelta() *Delta {
     var (
         w int32 = 64
         h int32 = 64
@@ -26,12 +28,21 @@ func BenchmarkJSONMarshalCells(b *testing.B) {
         }
     )
 
-    env := NewEnv(w, h, gs, 0, -1)
+    env, err := NewEnv(w, h, gs, 0, -1)
+    if err != nil {
+        panic(err)
+    }
     cells, _ := env.GetCells()
-    dt := &Delta{
+    return &Delta{
         Cells: cells,
         Stats: stats,
     }
+}
+
+func BenchmarkJSONMarshalCells(b *testing.B) {
+    b.ReportAllocs()
+
+    dt := newBenchDelta()
 
     b.ResetTimer()
 
@@ -39,3 +50,205 @@ func BenchmarkJSONMarshalCells(b *testing.B) {
         json.Marshal(dt)
     }
 }
+
+func BenchmarkBinaryMarshalCells(b *testing.B) {
+    b.ReportAllocs()
+
+    dt := newBenchDelta()
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        dt.MarshalBinary()
+    }
+}
+
+func BenchmarkJSONUnmarshalCells(b *testing.B) {
+    b.ReportAllocs()
+
+    js, _ := json.Marshal(newBenchDelta())
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        var dt Delta
+        json.Unmarshal(js, &dt)
+    }
+}
+
+func BenchmarkBinaryUnmarshalCells(b *testing.B) {
+    b.ReportAllocs()
+
+    bin, _ := newBenchDelta().MarshalBinary()
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        var dt Delta
+        dt.UnmarshalBinary(bin)
+    }
+}
+
+func TestEnvValidation(t *testing.T) {
+    for _, s := range [][4]int32{
+        {0, 4, 16, 0}, {4, -1, 16, 0}, {4, 4, 0, 0}, {4, 4, 16, 17},
+    } {
+        if _, err := NewEnv(s[0], s[1], s[2], s[3], 1); err == nil {
+            t.Errorf("NewEnv%v: expected error", s)
+        }
+    }
+
+    env, err := NewEnv(4, 4, 16, 16, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    c := env.GetConfig()
+    c.FailedKillPenalty = 0
+    if err := env.SetConfig(c); err == nil {
+        t.Error("SetConfig: expected error for FailedKillPenalty 0")
+    }
+    if env.GetConfig().FailedKillPenalty == 0 {
+        t.Error("SetConfig: invalid config was applied")
+    }
+
+    r := defaultRNG
+    r.InflowRateModifier = 0
+    if err := env.SetRNG(r); err == nil {
+        t.Error("SetRNG: expected error for InflowRateModifier 0")
+    }
+}
+
+func TestEnvPlacedLiveCells(t *testing.T) {
+    env, err := NewEnv(16, 16, 16, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, p := range [][2]int32{{1, 1}, {8, 8}, {14, 3}} {
+        if err := env.PlaceCell(p[0], p[1], gene.Genome{}, 1000, 0); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    dts := make(chan *Delta)
+    go env.Run(1, time.Millisecond, dts)
+    defer env.Stop()
+
+    dt := <-dts
+    if dt.Stats["LiveCells"] < 3 {
+        t.Fatalf("expected the placed cells to be live, got %d",
+            dt.Stats["LiveCells"])
+    }
+}
+
+// neverMutate is an RNG of another type than DefaultRNG.
+type neverMutate struct {
+    DefaultRNG
+}
+
+func (r neverMutate) Mutate(ctx *Context) bool {
+    return false
+}
+
+func TestEnvSetRNG(t *testing.T) {
+    env, err := NewEnv(4, 4, 16, 16, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, r := range []RNG{neverMutate{defaultRNG}, defaultRNG} {
+        if err := env.SetRNG(r); err != nil {
+            t.Fatal(err)
+        }
+        if env.GetRNG() != r {
+            t.Errorf("expected %T, got %T", r, env.GetRNG())
+        }
+    }
+}
+
+// runEnv runs a small env whose grid has fewer cells than the neighborhoods
+// of its processes, with callers of WithCells and Inject racing Stop.
+func runEnv(t *testing.T, stop func(*Env, <-chan *Delta)) {
+    env, err := NewEnv(4, 4, 16, 4, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dts := make(chan *Delta)
+    returned := make(chan struct{})
+    go func() {
+        env.Run(4, 50 * time.Microsecond, dts)
+        close(returned)
+    }()
+
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                err := env.WithCells(func(cs []*Cell) {})
+                if err == ErrStopped {
+                    return
+                } else if err != nil {
+                    t.Error(err)
+                    return
+                }
+                _, err = env.Inject(0, 0, gene.Genome{}, 100, 0)
+                if err == ErrStopped {
+                    return
+                }
+            }
+        }()
+    }
+
+    stop(env, dts)
+
+    select {
+    case <-returned:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Run did not return after Stop")
+    }
+    wg.Wait()
+
+    if err := env.WithCells(func(cs []*Cell) {}); err != ErrStopped {
+        t.Fatalf("expected ErrStopped, got %v", err)
+    }
+    if _, err := env.GetCells(); err != nil {
+        t.Fatalf("expected grid of stopped env, got %v", err)
+    }
+    env.Stop()
+}
+
+func TestEnvStop(t *testing.T) {
+    // Stop from the goroutine receiving deltas while they are still sent.
+    runEnv(t, func(env *Env, dts <-chan *Delta) {
+        for i := 0; i < 100; i++ {
+            <-dts
+        }
+        env.Stop()
+        for range dts {
+        }
+    })
+
+    // Stop from another goroutine without receiving deltas.
+    runEnv(t, func(env *Env, dts <-chan *Delta) {
+        time.Sleep(10 * time.Millisecond)
+        env.Stop()
+        if _, ok := <-dts; ok {
+            t.Error("expected deltas to be closed after Stop")
+        }
+    })
+}
+
+func TestEnvStopBeforeRun(t *testing.T) {
+    env, err := NewEnv(8, 8, 16, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    env.Stop()
+
+    dts := make(chan *Delta)
+    env.Run(1, time.Millisecond, dts)
+    if _, ok := <-dts; ok {
+        t.Fatal("expected deltas to be closed")
+    }
+}
@@ -0,0 +1,191 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package gene
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+)
+
+type EditOp int
+
+const (
+    MATCH EditOp = iota
+    SUBSTITUTE
+    INSERT
+    DELETE
+)
+
+var editOpNames = map[EditOp]string{
+    MATCH: "match",
+    SUBSTITUTE: "substitute",
+    INSERT: "insert",
+    DELETE: "delete",
+}
+
+var editOpMarks = map[EditOp]byte{
+    MATCH: ' ',
+    SUBSTITUTE: '*',
+    INSERT: '+',
+    DELETE: '-',
+}
+
+func (op EditOp) String() string {
+    return editOpNames[op]
+}
+
+func (op EditOp) MarshalJSON() ([]byte, error) {
+    return json.Marshal(op.String())
+}
+
+// Edit is one column of an alignment. A and B are indices into the aligned
+// genomes, or -1 when the column is a gap in that genome.
+type Edit struct {
+    Op EditOp
+    A int
+    B int
+    From Gene `json:"-"`
+    To Gene `json:"-"`
+}
+
+func (e Edit) MarshalJSON() ([]byte, error) {
+    type edit struct {
+        Op EditOp
+        A int
+        B int
+        From string `json:",omitempty"`
+        To string `json:",omitempty"`
+    }
+    j := edit{Op: e.Op, A: e.A, B: e.B}
+    if e.A >= 0 {
+        j.From = e.From.String()
+    }
+    if e.B >= 0 {
+        j.To = e.To.String()
+    }
+    return json.Marshal(j)
+}
+
+type Alignment struct {
+    Distance int
+    Edits []Edit
+}
+
+// Align computes the edit distance between a and b and an alignment
+// transforming a into b.
+func Align(a, b Genome) Alignment {
+    n, m := len(a), len(b)
+    w := m + 1
+    d := make([]int32, (n + 1) * w)
+
+    for i := 0; i <= n; i++ {
+        d[i * w] = int32(i)
+    }
+    for j := 0; j <= m; j++ {
+        d[j] = int32(j)
+    }
+    for i := 1; i <= n; i++ {
+        for j := 1; j <= m; j++ {
+            cost := int32(1)
+            if a[i - 1] == b[j - 1] {
+                cost = 0
+            }
+            v := d[(i - 1) * w + j - 1] + cost
+            if del := d[(i - 1) * w + j] + 1; del < v {
+                v = del
+            }
+            if ins := d[i * w + j - 1] + 1; ins < v {
+                v = ins
+            }
+            d[i * w + j] = v
+        }
+    }
+
+    edits := make([]Edit, 0, n + m)
+    i, j := n, m
+    for i > 0 || j > 0 {
+        v := d[i * w + j]
+        switch {
+        case i > 0 && j > 0 && a[i - 1] == b[j - 1] &&
+            v == d[(i - 1) * w + j - 1]:
+            i--
+            j--
+            edits = append(edits, Edit{MATCH, i, j, a[i], b[j]})
+        case i > 0 && j > 0 && v == d[(i - 1) * w + j - 1] + 1:
+            i--
+            j--
+            edits = append(edits, Edit{SUBSTITUTE, i, j, a[i], b[j]})
+        case i > 0 && v == d[(i - 1) * w + j] + 1:
+            i--
+            edits = append(edits, Edit{DELETE, i, -1, a[i], 0})
+        default:
+            j--
+            edits = append(edits, Edit{INSERT, -1, j, 0, b[j]})
+        }
+    }
+
+    for l, r := 0, len(edits) - 1; l < r; l, r = l + 1, r - 1 {
+        edits[l], edits[r] = edits[r], edits[l]
+    }
+
+    return Alignment{
+        Distance: int(d[n * w + m]),
+        Edits: edits,
+    }
+}
+
+// Changes returns the edits that are not matches.
+func (al Alignment) Changes() []Edit {
+    cs := make([]Edit, 0)
+    for _, e := range al.Edits {
+        if e.Op != MATCH {
+            cs = append(cs, e)
+        }
+    }
+    return cs
+}
+
+// WriteText writes the alignment as rows of width columns: the first
+// genome, the second genome and a marker row where '*' is a substitution,
+// '+' an insertion and '-' a deletion. Gaps are shown as spaces.
+func (al Alignment) WriteText(w io.Writer, width int) error {
+    if width < 1 {
+        width = len(al.Edits)
+    }
+
+    if _, err := fmt.Fprintf(w, "distance: %d\n", al.Distance); err != nil {
+        return err
+    }
+
+    for start := 0; start < len(al.Edits); start += width {
+        end := start + width
+        if end > len(al.Edits) {
+            end = len(al.Edits)
+        }
+
+        var ra, rb, rm strings.Builder
+        for _, e := range al.Edits[start:end] {
+            if e.A >= 0 {
+                ra.WriteString(e.From.String())
+            } else {
+                ra.WriteByte(' ')
+            }
+            if e.B >= 0 {
+                rb.WriteString(e.To.String())
+            } else {
+                rb.WriteByte(' ')
+            }
+            rm.WriteByte(editOpMarks[e.Op])
+        }
+
+        _, err := fmt.Fprintf(w, "\n%6d a %s\n%6s b %s\n%6s   %s\n",
+            start, ra.String(), "", rb.String(), "", rm.String())
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
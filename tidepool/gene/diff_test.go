@@ -0,0 +1,28 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package gene
+
+import (
+    "testing"
+)
+
+func TestAlign(t *testing.T) {
+    a, _ := ParseGenome("0+}gk.")
+    b, _ := ParseGenome("0+{gsk.")
+
+    al := Align(a, b)
+    if al.Distance != 2 {
+        t.Fatalf("expected distance 2, got %d", al.Distance)
+    }
+
+    cs := al.Changes()
+    if len(cs) != 2 {
+        t.Fatalf("expected 2 changes, got %v", cs)
+    }
+    if cs[0].Op != SUBSTITUTE || cs[0].A != 2 || cs[0].To != BACK {
+        t.Fatalf("unexpected substitution: %+v", cs[0])
+    }
+    if cs[1].Op != INSERT || cs[1].A != -1 || cs[1].B != 4 || cs[1].To != SHARE {
+        t.Fatalf("unexpected insertion: %+v", cs[1])
+    }
+}
@@ -3,7 +3,11 @@
 package gene
 
 import (
+    "encoding/binary"
     "encoding/json"
+    "errors"
+    "fmt"
+    "hash/fnv"
 )
 
 type Gene int
@@ -49,6 +53,29 @@ var geneChars = map[Gene]string{
     STOP: ".",
 }
 
+var geneNames = map[Gene]string{
+    ZERO: "ZERO",
+    FWD: "FWD",
+    BACK: "BACK",
+    INC: "INC",
+    DEC: "DEC",
+    READG: "READG",
+    WRITEG: "WRITEG",
+    READB: "READB",
+    WRITEB: "WRITEB",
+    LOOP: "LOOP",
+    REP: "REP",
+    TURN: "TURN",
+    XCHG: "XCHG",
+    KILL: "KILL",
+    SHARE: "SHARE",
+    STOP: "STOP",
+}
+
+func (g Gene) Name() string {
+    return geneNames[g]
+}
+
 func (g Gene) String() string {
     return geneChars[g]
 }
@@ -64,3 +91,114 @@ func (g Genome) String() string {
 func (g Genome) MarshalJSON() ([]byte, error) {
     return json.Marshal(g.String())
 }
+
+func (g *Genome) UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+        return err
+    }
+    p, err := ParseGenome(s)
+    if err != nil {
+        return err
+    }
+    *g = p
+    return nil
+}
+
+func ParseGene(r rune) (Gene, error) {
+    for g, c := range geneChars {
+        if c == string(r) {
+            return g, nil
+        }
+    }
+    return 0, fmt.Errorf("invalid gene: %q", r)
+}
+
+func ParseGenome(s string) (Genome, error) {
+    g := make(Genome, 0, len(s))
+    for _, r := range s {
+        v, err := ParseGene(r)
+        if err != nil {
+            return nil, err
+        }
+        g = append(g, v)
+    }
+    return g, nil
+}
+
+func (g Genome) Hash() uint64 {
+    b := make([]byte, len(g))
+    for i, gene := range g {
+        b[i] = byte(gene)
+    }
+    h := fnv.New64a()
+    h.Write(b)
+    return h.Sum64()
+}
+
+// Disassemble returns one line per gene with its index, character and name,
+// omitting the trailing run of STOP genes.
+func (g Genome) Disassemble() []string {
+    n := len(g)
+    for n > 1 && g[n - 1] == STOP && g[n - 2] == STOP {
+        n--
+    }
+
+    lines := make([]string, n)
+    for i, gene := range g[:n] {
+        lines[i] = fmt.Sprintf("%04d %s %s", i, gene, gene.Name())
+    }
+    return lines
+}
+
+// MarshalBinary packs the genome two genes per byte, prefixed by its length
+// as a uvarint.
+func (g Genome) MarshalBinary() ([]byte, error) {
+    return g.AppendBinary(nil), nil
+}
+
+func (g Genome) AppendBinary(b []byte) []byte {
+    var l [binary.MaxVarintLen64]byte
+    b = append(b, l[:binary.PutUvarint(l[:], uint64(len(g)))]...)
+
+    for i := 0; i < len(g); i += 2 {
+        v := byte(g[i]) << 4
+        if i + 1 < len(g) {
+            v |= byte(g[i + 1])
+        }
+        b = append(b, v)
+    }
+    return b
+}
+
+func (g *Genome) UnmarshalBinary(b []byte) error {
+    _, err := g.ReadBinary(b)
+    return err
+}
+
+// ReadBinary decodes a packed genome from the start of b and returns the
+// number of bytes read.
+func (g *Genome) ReadBinary(b []byte) (int, error) {
+    n, k := binary.Uvarint(b)
+    if k <= 0 {
+        return 0, errors.New("invalid genome length")
+    }
+    // Checked before rounding up so that n + 1 cannot overflow.
+    if n > uint64(len(b) - k) * 2 {
+        return 0, errors.New("genome truncated")
+    }
+    size := int((n + 1) / 2)
+
+    p := make(Genome, n)
+    for i := range p {
+        v := b[k + i / 2]
+        if i % 2 == 0 {
+            p[i] = Gene(v >> 4)
+        } else {
+            p[i] = Gene(v & 0xf)
+        }
+    }
+    *g = p
+
+    return k + size, nil
+}
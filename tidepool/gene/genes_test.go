@@ -0,0 +1,42 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package gene
+
+import (
+    "testing"
+)
+
+func TestReadBinaryMalformed(t *testing.T) {
+    for _, b := range [][]byte{
+        {},
+        {0x80},
+        {0x03, 0x12},
+        {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+    } {
+        var g Genome
+        if _, err := g.ReadBinary(b); err == nil {
+            t.Errorf("% x: expected error", b)
+        }
+    }
+}
+
+func FuzzReadBinary(f *testing.F) {
+    g, _ := ParseGenome("0+}gk.")
+    b, _ := g.MarshalBinary()
+    f.Add(b)
+    f.Fuzz(func(t *testing.T, b []byte) {
+        var g Genome
+        n, err := g.ReadBinary(b)
+        if err != nil {
+            return
+        }
+        if n > len(b) {
+            t.Fatalf("read %d of %d bytes", n, len(b))
+        }
+        c, _ := g.MarshalBinary()
+        var h Genome
+        if _, err := h.ReadBinary(c); err != nil || len(h) != len(g) {
+            t.Fatalf("round trip of %v failed: %v", g, err)
+        }
+    })
+}
@@ -0,0 +1,309 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync/atomic"
+
+    "tidepool/tidepool/gene"
+)
+
+// Grid is a read-only view of the grid of an env. It and the cell views it
+// returns are only valid during the function they are passed to.
+//
+// Cell, At and Neighborhood panic if idx is not in [0, Len()) or x, y are
+// outside of the grid; callers check positions from clients beforehand.
+type Grid interface {
+    Width() int32
+    Height() int32
+    // Len returns the number of cells.
+    Len() int
+    Cell(idx int32) CellView
+    At(x, y int32) CellView
+    // Neighborhood returns the cell at idx followed by its 8 neighbors.
+    Neighborhood(idx int32) [9]CellView
+}
+
+// MutableGrid is a view of the grid of an env that can change it. Changes
+// are visible through the view at once and applied to the grid only if the
+// function it is passed to returns nil. Cell IDs are taken when a cell is
+// placed or given energy, so IDs of changes that are not applied are skipped.
+type MutableGrid interface {
+    Grid
+    // Place puts a new live cell with genome g at x, y and returns its ID.
+    // Genomes shorter than the genome size are padded with STOP.
+    Place(x, y int32, g gene.Genome, energy, generation int64) (int64, error)
+    // SetEnergy sets the energy of the cell at x, y. A dead cell given
+    // energy becomes a new cell, as with an inflow.
+    SetEnergy(x, y int32, energy int64) error
+    // Clear replaces the cell at x, y with a blank cell.
+    Clear(x, y int32) error
+}
+
+// CellView is a read-only view of a cell.
+type CellView struct {
+    c *Cell
+}
+
+func (v CellView) Idx() int32 { return v.c.Idx }
+func (v CellView) X() int32 { return v.c.X }
+func (v CellView) Y() int32 { return v.c.Y }
+func (v CellView) ID() int64 { return v.c.ID }
+func (v CellView) Origin() int64 { return v.c.Origin }
+func (v CellView) Parent() int64 { return v.c.Parent }
+func (v CellView) Generation() int64 { return v.c.Generation }
+func (v CellView) Energy() int64 { return v.c.Energy }
+func (v CellView) Live() bool { return v.c.live() }
+func (v CellView) Viable(config Config) bool { return v.c.viable(config) }
+func (v CellView) GenomeLen() int { return len(v.c.Genome) }
+func (v CellView) Gene(i int) gene.Gene { return v.c.Genome[i] }
+
+// Genome returns a copy of the genome of the cell.
+func (v CellView) Genome() gene.Genome {
+    return append(gene.Genome(nil), v.c.Genome...)
+}
+
+// Copy returns a copy of the cell that may be kept and changed.
+func (v CellView) Copy() *Cell {
+    return v.c.clone()
+}
+
+// grid implements MutableGrid over the cells of an env, staging changes in
+// a CellMap. Views only expose it as a Grid through readGrid.
+type grid struct {
+    env *Env
+    cells []*Cell
+    staged CellMap
+}
+
+func (g *grid) Width() int32 { return g.env.Width }
+func (g *grid) Height() int32 { return g.env.Height }
+func (g *grid) Len() int { return len(g.cells) }
+
+func (g *grid) cell(idx int32) *Cell {
+    if c, ok := g.staged[idx]; ok {
+        return c
+    }
+    return g.cells[idx]
+}
+
+func (g *grid) Cell(idx int32) CellView {
+    return CellView{g.cell(idx)}
+}
+
+func (g *grid) At(x, y int32) CellView {
+    // Positions outside of the grid would otherwise wrap to another row.
+    if x < 0 || x >= g.env.Width || y < 0 || y >= g.env.Height {
+        panic(fmt.Sprintf("cell position %d,%d outside of grid", x, y))
+    }
+    return g.Cell(getIdx(x, y, g.env.Width))
+}
+
+func (g *grid) Neighborhood(idx int32) (vs [9]CellView) {
+    for i, c := range g.env.neighborhood(g.cells, idx) {
+        vs[i] = g.Cell(c.Idx)
+    }
+    return vs
+}
+
+// stage returns a copy of the cell at x, y that is applied to the grid with
+// the other changes.
+func (g *grid) stage(x, y int32) (*Cell, error) {
+    if x < 0 || x >= g.env.Width || y < 0 || y >= g.env.Height {
+        return nil, fmt.Errorf("cell position %d,%d outside of grid", x, y)
+    }
+    idx := getIdx(x, y, g.env.Width)
+    if c, ok := g.staged[idx]; ok {
+        return c, nil
+    }
+    c := g.cells[idx].clone()
+    g.staged[idx] = c
+    return c, nil
+}
+
+func (g *grid) Place(x, y int32, gn gene.Genome, energy, generation int64) (int64, error) {
+    if int32(len(gn)) > g.env.GenomeSize {
+        return 0, fmt.Errorf("genome of %d genes exceeds genome size %d",
+            len(gn), g.env.GenomeSize)
+    }
+    if energy < 1 {
+        return 0, fmt.Errorf("cell energy must be positive, got %d", energy)
+    }
+    c, err := g.stage(x, y)
+    if err != nil {
+        return 0, err
+    }
+
+    c.ID = g.env.getNextCellID()
+    c.Origin = c.ID
+    c.Parent = 0
+    c.Generation = generation
+    c.Energy = energy
+    c.resetGenome()
+    copy(c.Genome, gn)
+
+    return c.ID, nil
+}
+
+func (g *grid) SetEnergy(x, y int32, energy int64) error {
+    if energy < 0 {
+        return fmt.Errorf("cell energy must not be negative, got %d", energy)
+    }
+    c, err := g.stage(x, y)
+    if err != nil {
+        return err
+    }
+
+    if !c.live() && energy > 0 {
+        c.ID = g.env.getNextCellID()
+        c.Origin = c.ID
+        c.Parent = 0
+        c.Generation = 0
+    }
+    c.Energy = energy
+
+    return nil
+}
+
+func (g *grid) Clear(x, y int32) error {
+    c, err := g.stage(x, y)
+    if err != nil {
+        return err
+    }
+
+    c.ID = 0
+    c.Origin = 0
+    c.Parent = 0
+    c.Generation = 0
+    c.Energy = 0
+    c.resetGenome()
+
+    return nil
+}
+
+// readGrid hides the mutating methods of a grid from type assertions.
+type readGrid struct {
+    g *grid
+}
+
+func (r readGrid) Width() int32 { return r.g.Width() }
+func (r readGrid) Height() int32 { return r.g.Height() }
+func (r readGrid) Len() int { return r.g.Len() }
+func (r readGrid) Cell(idx int32) CellView { return r.g.Cell(idx) }
+func (r readGrid) At(x, y int32) CellView { return r.g.At(x, y) }
+func (r readGrid) Neighborhood(idx int32) [9]CellView {
+    return r.g.Neighborhood(idx)
+}
+
+// An update is a request to change the grid in the apply loop.
+type update struct {
+    f func(MutableGrid) error
+    stats Stats
+    err chan error
+}
+
+// run runs the update on cells and returns the delta of its changes, or nil
+// if there are none or it failed.
+func (u *update) run(e *Env, cells []*Cell) *Delta {
+    g := &grid{env: e, cells: cells, staged: make(CellMap)}
+    err := u.f(g)
+    u.err <- err
+    if err != nil || len(g.staged) == 0 {
+        return nil
+    }
+
+    dt := &Delta{
+        Cells: g.staged.Cells(),
+        Stats: Stats{
+            "Ticks": atomic.LoadInt64(&e.ticks),
+            "Updates": int64(len(g.staged)),
+        },
+    }
+    dt.Stats.Add(u.stats)
+    return dt
+}
+
+var errNotRunning = errors.New("Env is not running")
+
+// View runs f on the grid and returns its error. While the env runs, f runs
+// between ticks and the env waits for it, so f should return quickly. View
+// returns ctx.Err() if ctx is done before f starts.
+func (e *Env) View(ctx context.Context, f func(Grid) error) error {
+    var err error
+    run := func(cs []*Cell) {
+        err = f(readGrid{&grid{env: e, cells: cs}})
+    }
+
+    // The grid only changes between the start and the end of Run.
+    e.startMutex.RLock()
+    if atomic.LoadUint32(&e.started) == 0 {
+        run(e.cells)
+        e.startMutex.RUnlock()
+        return err
+    }
+    e.startMutex.RUnlock()
+
+    done := make(chan struct{})
+    req := func(cs []*Cell) {
+        run(cs)
+        close(done)
+    }
+    select {
+    case e.views <- req:
+        <-done
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-e.done:
+        run(e.cells)
+        return err
+    }
+}
+
+// Update runs f on the grid of the running env and applies its changes if it
+// returns nil. The changes are sent to consumers as a Delta with the stat
+// Updates. Cells in neighborhoods being executed may be overwritten when
+// their execution ends, as with any change between ticks. Update returns
+// ctx.Err() if ctx is done before f starts.
+func (e *Env) Update(ctx context.Context, f func(MutableGrid) error) error {
+    return e.update(ctx, nil, f)
+}
+
+func (e *Env) update(ctx context.Context, stats Stats,
+    f func(MutableGrid) error) error {
+    if atomic.LoadUint32(&e.replaying) == 1 {
+        return errors.New("cannot update the grid of a replay")
+    }
+    if e.context.Err() != nil {
+        return ErrStopped
+    }
+    if atomic.LoadUint32(&e.running) == 0 {
+        return errNotRunning
+    }
+
+    u := &update{f: f, stats: stats, err: make(chan error, 1)}
+    select {
+    case e.updates <- u:
+        return <-u.err
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-e.context.Done():
+        return ErrStopped
+    }
+}
+
+// GetCells returns a copy of the grid.
+func (e *Env) GetCells() ([]*Cell, error) {
+    var cells []*Cell
+    err := e.View(context.Background(), func(g Grid) error {
+        cells = make([]*Cell, g.Len())
+        for i := range cells {
+            cells[i] = g.Cell(int32(i)).Copy()
+        }
+        return nil
+    })
+    return cells, err
+}
@@ -0,0 +1,125 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "tidepool/tidepool/gene"
+)
+
+func TestGridView(t *testing.T) {
+    env, err := NewEnv(8, 8, 16, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = env.View(context.Background(), func(g Grid) error {
+        if _, ok := g.(MutableGrid); ok {
+            t.Error("view is mutable")
+        }
+        if g.Len() != 64 || g.At(3, 2).Idx() != 19 {
+            t.Errorf("unexpected grid of %d cells", g.Len())
+        }
+        gn := g.Cell(0).Genome()
+        gn[0] = gene.Gene(1)
+
+        defer func() {
+            if recover() == nil {
+                t.Error("expected panic for position outside of grid")
+            }
+        }()
+        g.At(8, 0)
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    cells, _ := env.GetCells()
+    if cells[0].Genome[0] != gene.STOP {
+        t.Error("genome of view is shared with the grid")
+    }
+
+    if err := env.Update(context.Background(),
+        func(g MutableGrid) error { return nil }); err != errNotRunning {
+        t.Errorf("expected errNotRunning, got %v", err)
+    }
+}
+
+func TestGridUpdate(t *testing.T) {
+    env, err := NewEnv(8, 8, 16, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dts := make(chan *Delta, 16)
+    go env.Run(1, time.Hour, dts)
+    defer env.Stop()
+
+    // Wait for Run to start.
+    for env.Update(context.Background(),
+        func(g MutableGrid) error { return nil }) == errNotRunning {
+        time.Sleep(time.Millisecond)
+    }
+
+    failed := errors.New("failed")
+    err = env.Update(context.Background(), func(g MutableGrid) error {
+        g.SetEnergy(1, 1, 100)
+        if g.At(1, 1).Energy() != 100 {
+            t.Error("change not visible through the grid")
+        }
+        return failed
+    })
+    if err != failed {
+        t.Fatalf("expected %v, got %v", failed, err)
+    }
+
+    var id int64
+    err = env.Update(context.Background(), func(g MutableGrid) error {
+        id, err = g.Place(2, 2, gene.Genome{gene.Gene(1)}, 50, 3)
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    dt := <-dts
+    if len(dt.Cells) != 1 || dt.Cells[0].ID != id || dt.Stats["Updates"] != 1 {
+        t.Fatalf("unexpected delta %+v", dt)
+    }
+
+    env.View(context.Background(), func(g Grid) error {
+        if g.At(1, 1).Live() {
+            t.Error("change of failed update applied")
+        }
+        if c := g.At(2, 2); c.ID() != id || c.Generation() != 3 {
+            t.Error("change of update not applied")
+        }
+        return nil
+    })
+
+    // The env waits for f, so other requests wait until ctx is done.
+    block := make(chan struct{})
+    go env.View(context.Background(), func(g Grid) error {
+        <-block
+        return nil
+    })
+    ctx, cancel := context.WithTimeout(context.Background(),
+        10 * time.Millisecond)
+    defer cancel()
+    time.Sleep(time.Millisecond)
+    if err := env.View(ctx, func(g Grid) error {
+        return nil
+    }); err != context.DeadlineExceeded {
+        t.Errorf("expected DeadlineExceeded, got %v", err)
+    }
+    close(block)
+
+    env.Stop()
+    if err := env.Update(context.Background(),
+        func(g MutableGrid) error { return nil }); err != ErrStopped {
+        t.Errorf("expected ErrStopped, got %v", err)
+    }
+}
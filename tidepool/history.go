@@ -0,0 +1,189 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "encoding/csv"
+    "io"
+    "sort"
+    "strconv"
+    "sync"
+)
+
+type Sample struct {
+    Tick int64
+    Stats Stats
+}
+
+type ring struct {
+    samples []Sample
+    start int
+    n int
+}
+
+func newRing(size int) *ring {
+    return &ring{
+        samples: make([]Sample, size),
+    }
+}
+
+func (r *ring) full() bool {
+    return r.n == len(r.samples)
+}
+
+// push appends s and returns the evicted sample, if any.
+func (r *ring) push(s Sample) (Sample, bool) {
+    if len(r.samples) == 0 {
+        return s, true
+    }
+    if r.full() {
+        old := r.samples[r.start]
+        r.samples[r.start] = s
+        r.start = (r.start + 1) % len(r.samples)
+        return old, true
+    }
+    r.samples[(r.start + r.n) % len(r.samples)] = s
+    r.n++
+    return Sample{}, false
+}
+
+func (r *ring) each(f func(Sample)) {
+    for i := 0; i < r.n; i++ {
+        f(r.samples[(r.start + i) % len(r.samples)])
+    }
+}
+
+// History is a bounded time-series of Stats snapshots taken every interval
+// ticks. The most recent samples are kept at full resolution; samples
+// evicted from a level are downsampled by factor into the next level.
+type History struct {
+    interval int64
+    factor int
+    lastTick int64
+
+    mutex sync.RWMutex
+    levels []*ring
+    pending []int
+}
+
+func NewHistory(interval int64, size, levels, factor int) *History {
+    if interval < 1 {
+        interval = 1
+    }
+    if levels < 1 {
+        levels = 1
+    }
+    if factor < 1 {
+        factor = 1
+    }
+
+    h := &History{
+        interval: interval,
+        factor: factor,
+        lastTick: -interval,
+        levels: make([]*ring, levels),
+        pending: make([]int, levels),
+    }
+    for i := range h.levels {
+        h.levels[i] = newRing(size)
+    }
+
+    return h
+}
+
+func (h *History) Interval() int64 {
+    return h.interval
+}
+
+// Add records a copy of s if at least interval ticks have passed since the
+// last recorded sample. It reports whether a sample was recorded.
+func (h *History) Add(s Stats) bool {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    tick := s["Ticks"]
+    if tick - h.lastTick < h.interval {
+        return false
+    }
+    h.lastTick = tick
+
+    sm := Sample{
+        Tick: tick,
+        Stats: s.Copy(),
+    }
+
+    for i, r := range h.levels {
+        old, evicted := r.push(sm)
+        if !evicted || i == len(h.levels) - 1 {
+            break
+        }
+        // Keep the latest sample of every factor evicted samples.
+        h.pending[i + 1]++
+        if h.pending[i + 1] < h.factor {
+            break
+        }
+        h.pending[i + 1] = 0
+        sm = old
+    }
+
+    return true
+}
+
+// Range returns the samples with from <= Tick <= to in tick order. A
+// negative to is unbounded.
+func (h *History) Range(from, to int64) []Sample {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    ss := make([]Sample, 0)
+    for i := len(h.levels) - 1; i >= 0; i-- {
+        h.levels[i].each(func(s Sample) {
+            if s.Tick < from || (to >= 0 && s.Tick > to) {
+                return
+            }
+            if n := len(ss); n > 0 && ss[n - 1].Tick >= s.Tick {
+                return
+            }
+            ss = append(ss, s)
+        })
+    }
+
+    return ss
+}
+
+func (h *History) WriteCSV(w io.Writer, from, to int64) error {
+    ss := h.Range(from, to)
+
+    names := make(map[string]bool)
+    for _, s := range ss {
+        for n := range s.Stats {
+            if n != "Ticks" {
+                names[n] = true
+            }
+        }
+    }
+    header := []string{"Ticks"}
+    for n := range names {
+        header = append(header, n)
+    }
+    sort.Strings(header[1:])
+
+    cw := csv.NewWriter(w)
+    if err := cw.Write(header); err != nil {
+        return err
+    }
+
+    record := make([]string, len(header))
+    for _, s := range ss {
+        record[0] = strconv.FormatInt(s.Tick, 10)
+        for i, n := range header[1:] {
+            record[i + 1] = strconv.FormatInt(s.Stats[n], 10)
+        }
+        if err := cw.Write(record); err != nil {
+            return err
+        }
+    }
+    cw.Flush()
+
+    return cw.Error()
+}
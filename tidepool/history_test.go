@@ -0,0 +1,33 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "testing"
+)
+
+func TestHistoryDownsample(t *testing.T) {
+    h := NewHistory(10, 4, 2, 2)
+
+    for tick := int64(0); tick <= 200; tick++ {
+        h.Add(Stats{"Ticks": tick, "LiveCells": tick * 2})
+    }
+
+    ss := h.Range(0, -1)
+    if len(ss) != 8 {
+        t.Fatalf("expected 8 samples, got %d", len(ss))
+    }
+    for i := 1; i < len(ss); i++ {
+        if ss[i].Tick <= ss[i - 1].Tick {
+            t.Fatalf("samples out of order: %v", ss)
+        }
+    }
+    if last := ss[len(ss) - 1]; last.Tick != 200 || last.Stats["LiveCells"] != 400 {
+        t.Fatalf("unexpected last sample: %v", last)
+    }
+
+    ss = h.Range(170, 190)
+    if len(ss) != 3 || ss[0].Tick != 170 || ss[2].Tick != 190 {
+        t.Fatalf("unexpected range: %v", ss)
+    }
+}
@@ -0,0 +1,81 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "sync"
+)
+
+type Ancestor struct {
+    ID int64
+    Parent int64
+    Origin int64
+    Generation int64
+    Hash uint64
+    FirstSeen int64
+}
+
+// Lineage remembers the parent of the most recently seen cells, up to a
+// fixed number of cells.
+type Lineage struct {
+    mutex sync.RWMutex
+    entries map[int64]Ancestor
+    order []int64
+    next int
+}
+
+func NewLineage(size int) *Lineage {
+    if size < 1 {
+        size = 1
+    }
+    return &Lineage{
+        entries: make(map[int64]Ancestor),
+        order: make([]int64, size),
+    }
+}
+
+func (l *Lineage) Apply(dt *Delta) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    tick := dt.Stats["Ticks"]
+    for _, c := range dt.Cells {
+        if c.ID == 0 {
+            continue
+        }
+        if _, ok := l.entries[c.ID]; ok {
+            continue
+        }
+
+        if old := l.order[l.next]; old != 0 {
+            delete(l.entries, old)
+        }
+        l.order[l.next] = c.ID
+        l.next = (l.next + 1) % len(l.order)
+
+        l.entries[c.ID] = Ancestor{
+            ID: c.ID,
+            Parent: c.Parent,
+            Origin: c.Origin,
+            Generation: c.Generation,
+            Hash: c.Genome.Hash(),
+            FirstSeen: tick,
+        }
+    }
+}
+
+// Ancestors returns up to max known ancestors of the cell with the given ID,
+// starting with its parent.
+func (l *Lineage) Ancestors(id int64, max int) []Ancestor {
+    l.mutex.RLock()
+    defer l.mutex.RUnlock()
+
+    as := make([]Ancestor, 0)
+    a, ok := l.entries[id]
+    for ok && a.Parent != 0 && len(as) < max {
+        if a, ok = l.entries[a.Parent]; ok {
+            as = append(as, a)
+        }
+    }
+    return as
+}
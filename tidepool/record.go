@@ -0,0 +1,465 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+// A recording starts with recordMagic followed by frames, each made of a
+// frame type byte and a length-prefixed payload. The first frame is the
+// header, followed by an initial keyframe and then deltas, with a keyframe of
+// the full grid every keyframe interval ticks.
+const recordMagic = "TPREC"
+
+const (
+    frameHeader byte = 'H'
+    frameKeyframe byte = 'K'
+    frameDelta byte = 'D'
+)
+
+var ErrRecording = errors.New("invalid recording")
+
+type RecordHeader struct {
+    Width int32
+    Height int32
+    GenomeSize int32
+    Seed int64
+    Config Config
+}
+
+type Recorder struct {
+    w *bufio.Writer
+    interval int64
+    lastKeyframe int64
+    ticks int64
+    cells []*Cell
+    stats Stats
+}
+
+// NewRecorder writes the header and an initial keyframe of cs, the cells of
+// e, to w. A keyframe is written every interval ticks; 0 writes only the
+// initial keyframe.
+func NewRecorder(w io.Writer, e *Env, cs []*Cell, interval int64) (*Recorder, error) {
+    r := &Recorder{
+        w: bufio.NewWriter(w),
+        interval: interval,
+        cells: make([]*Cell, len(cs)),
+        stats: make(Stats),
+    }
+    for i, c := range cs {
+        r.cells[i] = c.clone()
+    }
+
+    h, err := json.Marshal(RecordHeader{
+        Width: e.Width,
+        Height: e.Height,
+        GenomeSize: e.GenomeSize,
+        Seed: e.Seed,
+        Config: e.GetConfig(),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := r.w.WriteString(recordMagic); err != nil {
+        return nil, err
+    }
+    if err := r.writeFrame(frameHeader, h); err != nil {
+        return nil, err
+    }
+    if err := r.writeKeyframe(); err != nil {
+        return nil, err
+    }
+
+    return r, nil
+}
+
+func (r *Recorder) writeFrame(t byte, b []byte) error {
+    if err := r.w.WriteByte(t); err != nil {
+        return err
+    }
+    return writeFrame(r.w, b)
+}
+
+func (r *Recorder) writeKeyframe() error {
+    stats := r.stats.Copy()
+    stats["Ticks"] = r.ticks
+    b, err := (&Delta{Cells: r.cells, Stats: stats}).MarshalBinary()
+    if err != nil {
+        return err
+    }
+    r.lastKeyframe = r.ticks
+    return r.writeFrame(frameKeyframe, b)
+}
+
+func (r *Recorder) Record(dt *Delta) error {
+    for _, c := range dt.Cells {
+        if c.Idx < 0 || int(c.Idx) >= len(r.cells) ||
+            len(c.Genome) != len(r.cells[c.Idx].Genome) {
+            return fmt.Errorf("cell %d does not fit the recorded grid", c.Idx)
+        }
+    }
+    b, err := dt.MarshalBinary()
+    if err != nil {
+        return err
+    }
+    if err := r.writeFrame(frameDelta, b); err != nil {
+        return err
+    }
+
+    for _, c := range dt.Cells {
+        c.overwrite(r.cells[c.Idx])
+    }
+    r.stats.Add(dt.Stats)
+    if t := dt.Stats["Ticks"]; t > r.ticks {
+        r.ticks = t
+    }
+
+    if r.interval > 0 && r.ticks - r.lastKeyframe >= r.interval {
+        return r.writeKeyframe()
+    }
+    return nil
+}
+
+func (r *Recorder) Flush() error {
+    return r.w.Flush()
+}
+
+type keyframe struct {
+    tick int64
+    offset int64
+}
+
+type countReader struct {
+    r io.Reader
+    n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+    n, err := cr.r.Read(p)
+    cr.n += int64(n)
+    return n, err
+}
+
+// Replay reads a recording written by a Recorder.
+type Replay struct {
+    Header RecordHeader
+
+    rs io.ReadSeeker
+    r *bufio.Reader
+    keyframes []keyframe
+    ticks int64
+    pending *Delta
+}
+
+func OpenReplay(rs io.ReadSeeker) (*Replay, error) {
+    p := &Replay{rs: rs}
+
+    cr := &countReader{r: rs}
+    br := bufio.NewReader(cr)
+    offset := func() int64 {
+        return cr.n - int64(br.Buffered())
+    }
+
+    magic := make([]byte, len(recordMagic))
+    if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordMagic {
+        return nil, ErrRecording
+    }
+
+    t, b, err := readTypedFrame(br)
+    if err != nil {
+        return nil, err
+    }
+    if t != frameHeader {
+        return nil, fmt.Errorf("%w: missing header", ErrRecording)
+    }
+    if err := json.Unmarshal(b, &p.Header); err != nil {
+        return nil, err
+    }
+
+    // Index keyframes.
+    for {
+        off := offset()
+        t, tick, err := skipFrame(br)
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        if t != frameKeyframe && t != frameDelta {
+            return nil, fmt.Errorf("%w: unknown frame type %q", ErrRecording, t)
+        }
+
+        if tick > p.ticks {
+            p.ticks = tick
+        }
+        if t == frameKeyframe {
+            p.keyframes = append(p.keyframes, keyframe{tick, off})
+        }
+    }
+
+    if len(p.keyframes) == 0 {
+        return nil, fmt.Errorf("%w: missing keyframe", ErrRecording)
+    }
+
+    return p, nil
+}
+
+func readTypedFrame(r *bufio.Reader) (byte, []byte, error) {
+    t, err := r.ReadByte()
+    if err != nil {
+        return 0, nil, err
+    }
+    b, err := readFrame(r)
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return t, b, err
+}
+
+// skipFrame reads a frame and returns its type and the Ticks stat of its
+// payload without decoding its cells.
+func skipFrame(r *bufio.Reader) (byte, int64, error) {
+    t, err := r.ReadByte()
+    if err != nil {
+        return 0, 0, err
+    }
+    n, err := binary.ReadUvarint(r)
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    if err != nil {
+        return 0, 0, err
+    }
+    if n > maxFrameSize {
+        return 0, 0, fmt.Errorf("frame of %d bytes exceeds %d", n, maxFrameSize)
+    }
+
+    // The stats come first and fit in the buffer of r.
+    peek := n
+    if peek > uint64(r.Size()) {
+        peek = uint64(r.Size())
+    }
+    b, err := r.Peek(int(peek))
+    if err != nil {
+        return 0, 0, io.ErrUnexpectedEOF
+    }
+    wr := &wireReader{b: b}
+    wr.version()
+    stats := wr.stats()
+    if wr.err != nil {
+        return 0, 0, fmt.Errorf("%w: %v", ErrRecording, wr.err)
+    }
+
+    if _, err := r.Discard(int(n)); err != nil {
+        return 0, 0, io.ErrUnexpectedEOF
+    }
+    return t, stats["Ticks"], nil
+}
+
+// checkCells returns an error unless cs fit the recorded grid.
+func (p *Replay) checkCells(cs []*Cell) error {
+    h := p.Header
+    for _, c := range cs {
+        if c.Idx < 0 || c.Idx >= h.Width * h.Height {
+            return fmt.Errorf("%w: cell index %d outside of grid",
+                ErrRecording, c.Idx)
+        }
+        if c.X != c.Idx % h.Width || c.Y != c.Idx / h.Width {
+            return fmt.Errorf("%w: cell %d at %d,%d", ErrRecording, c.Idx,
+                c.X, c.Y)
+        }
+        if int32(len(c.Genome)) != h.GenomeSize {
+            return fmt.Errorf("%w: cell %d has %d genes, expected %d",
+                ErrRecording, c.Idx, len(c.Genome), h.GenomeSize)
+        }
+    }
+    return nil
+}
+
+// Ticks returns the last tick in the recording.
+func (p *Replay) Ticks() int64 {
+    return p.ticks
+}
+
+// NewEnv returns an Env matching the recorded environment.
+func (p *Replay) NewEnv() (*Env, error) {
+    h := p.Header
+    e, err := NewEnv(h.Width, h.Height, h.GenomeSize, 0, h.Seed)
+    if err != nil {
+        return nil, err
+    }
+    if err := e.SetConfig(h.Config); err != nil {
+        return nil, err
+    }
+    return e, nil
+}
+
+// SeekTick positions the replay at tick and returns the grid and cumulative
+// stats at that tick. Subsequent calls to Next return the following deltas.
+func (p *Replay) SeekTick(tick int64) ([]*Cell, Stats, error) {
+    i := sort.Search(len(p.keyframes), func(i int) bool {
+        return p.keyframes[i].tick > tick
+    }) - 1
+    if i < 0 {
+        i = 0
+    }
+
+    if _, err := p.rs.Seek(p.keyframes[i].offset, io.SeekStart); err != nil {
+        return nil, nil, err
+    }
+    p.r = bufio.NewReader(p.rs)
+
+    _, b, err := readTypedFrame(p.r)
+    if err != nil {
+        return nil, nil, err
+    }
+    var key Delta
+    if err := key.UnmarshalBinary(b); err != nil {
+        return nil, nil, err
+    }
+    if err := p.checkCells(key.Cells); err != nil {
+        return nil, nil, err
+    }
+
+    cells := make([]*Cell, p.Header.Width * p.Header.Height)
+    for _, c := range key.Cells {
+        cells[c.Idx] = c
+    }
+    for i, c := range cells {
+        if c == nil {
+            return nil, nil, fmt.Errorf("%w: keyframe lacks cell %d",
+                ErrRecording, i)
+        }
+    }
+    stats := key.Stats
+
+    p.pending = nil
+    for {
+        dt, err := p.Next()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, nil, err
+        }
+        if dt.Stats["Ticks"] > tick {
+            p.pending = dt
+            break
+        }
+        for _, c := range dt.Cells {
+            cells[c.Idx] = c
+        }
+        stats.Add(dt.Stats)
+    }
+
+    return cells, stats, nil
+}
+
+// Next returns the next delta in the recording, or io.EOF at its end.
+func (p *Replay) Next() (*Delta, error) {
+    if p.r == nil {
+        if _, _, err := p.SeekTick(0); err != nil {
+            return nil, err
+        }
+    }
+    if dt := p.pending; dt != nil {
+        p.pending = nil
+        return dt, nil
+    }
+    for {
+        t, b, err := readTypedFrame(p.r)
+        if err != nil {
+            return nil, err
+        }
+        if t != frameDelta {
+            continue
+        }
+        dt := &Delta{}
+        if err := dt.UnmarshalBinary(b); err != nil {
+            return nil, err
+        }
+        if err := p.checkCells(dt.Cells); err != nil {
+            return nil, err
+        }
+        return dt, nil
+    }
+}
+
+// Replay applies the deltas of p to the grid of e, one recorded tick every
+// tick, and sends them to deltas. It is a drop-in replacement for Run, except
+// that it returns and closes deltas at the end of the recording; the env then
+// keeps the grid of the last recorded tick.
+func (e *Env) Replay(p *Replay, start int64, tick time.Duration,
+    deltas chan<- *Delta) error {
+    defer close(deltas)
+    atomic.StoreUint32(&e.replaying, 1)
+    h := p.Header
+    if h.Width != e.Width || h.Height != e.Height ||
+        h.GenomeSize != e.GenomeSize {
+        return fmt.Errorf("%w: recorded grid does not match the env",
+            ErrRecording)
+    }
+    if !e.start() {
+        return nil
+    }
+    defer e.finish()
+
+    cells, _, err := p.SeekTick(start)
+    if err != nil {
+        return err
+    }
+    for _, c := range cells {
+        c.overwrite(e.cells[c.Idx])
+    }
+
+    ticker := time.NewTicker(tick)
+    defer ticker.Stop()
+
+    ticks := start
+    var next *Delta
+
+    for {
+        select {
+        case <-e.context.Done():
+            return nil
+        case f := <-e.views:
+            f(e.cells)
+        case <-ticker.C:
+            if !e.advance() {
+                continue
+            }
+            ticks++
+            atomic.StoreInt64(&e.ticks, ticks)
+            for {
+                if next == nil {
+                    if next, err = p.Next(); err == io.EOF {
+                        return nil
+                    } else if err != nil {
+                        return err
+                    }
+                }
+                if next.Stats["Ticks"] > ticks {
+                    break
+                }
+                for _, c := range next.Cells {
+                    c.overwrite(e.cells[c.Idx])
+                }
+                select {
+                case deltas <- next:
+                case <-e.context.Done():
+                    return nil
+                }
+                next = nil
+            }
+        }
+    }
+}
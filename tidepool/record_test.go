@@ -0,0 +1,179 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestRecordReplay(t *testing.T) {
+    env, err := NewEnv(4, 4, 8, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cells, _ := env.GetCells()
+
+    var buf bytes.Buffer
+    rec, err := NewRecorder(&buf, env, cells, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for tick := int64(1); tick <= 10; tick++ {
+        c := cells[tick % 16].clone()
+        c.Energy = tick
+        dt := &Delta{
+            Cells: []*Cell{c},
+            Stats: Stats{"Ticks": tick, "Reproductions": 1},
+        }
+        if err := rec.Record(dt); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := rec.Flush(); err != nil {
+        t.Fatal(err)
+    }
+
+    rp, err := OpenReplay(bytes.NewReader(buf.Bytes()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rp.Ticks() != 10 || len(rp.keyframes) != 3 {
+        t.Fatalf("unexpected index: ticks %d, keyframes %v", rp.Ticks(),
+            rp.keyframes)
+    }
+
+    cs, stats, err := rp.SeekTick(6)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stats["Ticks"] != 6 || stats["Reproductions"] != 6 {
+        t.Fatalf("unexpected stats: %v", stats)
+    }
+    if cs[6].Energy != 6 || cs[7].Energy != 0 {
+        t.Fatalf("unexpected cells at tick 6: %v %v", cs[6], cs[7])
+    }
+
+    dt, err := rp.Next()
+    if err != nil || dt.Stats["Ticks"] != 7 {
+        t.Fatalf("unexpected next delta: %v %v", dt, err)
+    }
+}
+
+func TestReplayEnd(t *testing.T) {
+    env, err := NewEnv(4, 4, 8, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cells, _ := env.GetCells()
+
+    var buf bytes.Buffer
+    rec, err := NewRecorder(&buf, env, cells, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for tick := int64(1); tick <= 5; tick++ {
+        c := cells[tick].clone()
+        c.Energy = tick
+        err := rec.Record(&Delta{Cells: []*Cell{c}, Stats: Stats{"Ticks": tick}})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := rec.Flush(); err != nil {
+        t.Fatal(err)
+    }
+
+    rp, err := OpenReplay(bytes.NewReader(buf.Bytes()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    env, err = NewEnv(4, 4, 8, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dts := make(chan *Delta)
+    errs := make(chan error, 1)
+    go func() {
+        errs <- env.Replay(rp, 0, time.Microsecond, dts)
+    }()
+
+    n := 0
+    timeout := time.After(5 * time.Second)
+    for done := false; !done; {
+        select {
+        case _, ok := <-dts:
+            if !ok {
+                done = true
+            } else {
+                n++
+            }
+        case <-timeout:
+            t.Fatal("deltas not closed at the end of the recording")
+        }
+    }
+    if err := <-errs; err != nil || n != 5 {
+        t.Fatalf("expected 5 deltas and no error, got %d, %v", n, err)
+    }
+    cs, _ := env.GetCells()
+    if cs[5].Energy != 5 {
+        t.Fatalf("expected grid of the last tick, got %v", cs[5])
+    }
+}
+
+func TestReplayCorrupt(t *testing.T) {
+    env, err := NewEnv(4, 4, 8, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cells, _ := env.GetCells()
+
+    record := func(cs []*Cell, dt *Delta) *Replay {
+        var buf bytes.Buffer
+        rec, err := NewRecorder(&buf, env, cs, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if dt != nil {
+            // Written directly as Record rejects such cells.
+            b, _ := dt.MarshalBinary()
+            if err := rec.writeFrame(frameDelta, b); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := rec.Flush(); err != nil {
+            t.Fatal(err)
+        }
+        rp, err := OpenReplay(bytes.NewReader(buf.Bytes()))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return rp
+    }
+
+    outside := cells[1].clone()
+    outside.Idx = 16
+    long := newCell(1, 1, 0, 9)
+    for name, rp := range map[string]*Replay{
+        "missing cells": record(cells[:3], nil),
+        "index": record(cells, &Delta{Cells: []*Cell{outside},
+            Stats: Stats{"Ticks": 1}}),
+        "genome": record(cells, &Delta{Cells: []*Cell{long},
+            Stats: Stats{"Ticks": 1}}),
+    } {
+        if _, _, err := rp.SeekTick(1); !errors.Is(err, ErrRecording) {
+            t.Errorf("%s: expected ErrRecording, got %v", name, err)
+        }
+    }
+
+    rec, err := NewRecorder(&bytes.Buffer{}, env, cells, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := rec.Record(&Delta{Cells: []*Cell{outside}}); err == nil {
+        t.Error("expected error recording a cell outside of the grid")
+    }
+}
@@ -0,0 +1,172 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "fmt"
+    "hash/fnv"
+    "image"
+    "image/color"
+    "sort"
+)
+
+// A ColourScheme inspects the grid once and returns the colour of each of
+// its cells. Cells that are not live are black in every scheme.
+type ColourScheme func(cs []*Cell, config Config) func(*Cell) color.RGBA
+
+var black = color.RGBA{A: 255}
+
+// ColourSchemes holds the schemes available to Render by name.
+var ColourSchemes = map[string]ColourScheme{
+    // The colour key of the genome, as on the web page. Cells that are not
+    // viable are black.
+    "genotype": genotypeScheme,
+    // Energy relative to the most energetic cell.
+    "energy": energyScheme,
+    // Generation relative to the highest generation.
+    "generation": generationScheme,
+    // A colour per Origin, so that cells descended from the same inflow share
+    // a colour.
+    "origin": originScheme,
+    // Cell IDs increase as cells are born, so the newest cells are the
+    // brightest.
+    "age": ageScheme,
+}
+
+func ParseColourScheme(name string) (ColourScheme, error) {
+    if s, ok := ColourSchemes[name]; ok {
+        return s, nil
+    }
+    return nil, fmt.Errorf("invalid colour scheme: %s", name)
+}
+
+// ColourSchemeNames returns the names of ColourSchemes in sorted order.
+func ColourSchemeNames() []string {
+    ns := make([]string, 0, len(ColourSchemes))
+    for n := range ColourSchemes {
+        ns = append(ns, n)
+    }
+    sort.Strings(ns)
+    return ns
+}
+
+// Heat maps t in [0, 1] from black through red and yellow to white.
+func Heat(t float64) color.RGBA {
+    if t < 0 {
+        t = 0
+    } else if t > 1 {
+        t = 1
+    }
+    v := t * 3
+    c := black
+    switch {
+    case v < 1:
+        c.R = uint8(v * 255)
+    case v < 2:
+        c.R, c.G = 255, uint8((v - 1) * 255)
+    default:
+        c.R, c.G, c.B = 255, 255, uint8((v - 2) * 255)
+    }
+    return c
+}
+
+func keyColour(k uint64) color.RGBA {
+    return color.RGBA{R: uint8(k >> 16), G: uint8(k >> 8), B: uint8(k), A: 255}
+}
+
+func genotypeScheme(cs []*Cell, config Config) func(*Cell) color.RGBA {
+    return func(c *Cell) color.RGBA {
+        if !c.live() || !c.viable(config) {
+            return black
+        }
+        return keyColour(c.Genome.Hash() & 0xffffff)
+    }
+}
+
+// relativeScheme colours live cells by v relative to its maximum over the
+// grid.
+func relativeScheme(cs []*Cell, v func(*Cell) int64) func(*Cell) color.RGBA {
+    var max int64
+    for _, c := range cs {
+        if c.live() && v(c) > max {
+            max = v(c)
+        }
+    }
+    return func(c *Cell) color.RGBA {
+        if !c.live() {
+            return black
+        }
+        if max == 0 {
+            return Heat(1)
+        }
+        return Heat(float64(v(c)) / float64(max))
+    }
+}
+
+func energyScheme(cs []*Cell, config Config) func(*Cell) color.RGBA {
+    return relativeScheme(cs, func(c *Cell) int64 { return c.Energy })
+}
+
+func generationScheme(cs []*Cell, config Config) func(*Cell) color.RGBA {
+    return relativeScheme(cs, func(c *Cell) int64 { return c.Generation })
+}
+
+func originScheme(cs []*Cell, config Config) func(*Cell) color.RGBA {
+    return func(c *Cell) color.RGBA {
+        if !c.live() {
+            return black
+        }
+        h := fnv.New64a()
+        fmt.Fprint(h, c.Origin)
+        return keyColour(h.Sum64())
+    }
+}
+
+func ageScheme(cs []*Cell, config Config) func(*Cell) color.RGBA {
+    var min int64 = -1
+    var max int64
+    for _, c := range cs {
+        if !c.live() {
+            continue
+        }
+        if min < 0 || c.ID < min {
+            min = c.ID
+        }
+        if c.ID > max {
+            max = c.ID
+        }
+    }
+    return func(c *Cell) color.RGBA {
+        if !c.live() {
+            return black
+        }
+        if max == min {
+            return Heat(1)
+        }
+        return Heat(float64(c.ID - min) / float64(max - min))
+    }
+}
+
+// Render draws the grid cs of the given size with each cell as a square of
+// scale pixels.
+func Render(cs []*Cell, width, height int32, config Config,
+    scheme ColourScheme, scale int) *image.RGBA {
+    if scale < 1 {
+        scale = 1
+    }
+    img := image.NewRGBA(image.Rect(0, 0, int(width) * scale,
+        int(height) * scale))
+    colour := scheme(cs, config)
+
+    for _, c := range cs {
+        col := colour(c)
+        x0, y0 := int(c.X) * scale, int(c.Y) * scale
+        for y := y0; y < y0 + scale; y++ {
+            for x := x0; x < x0 + scale; x++ {
+                img.SetRGBA(x, y, col)
+            }
+        }
+    }
+
+    return img
+}
@@ -0,0 +1,61 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "image/color"
+    "testing"
+
+    "tidepool/tidepool/gene"
+)
+
+func TestRender(t *testing.T) {
+    cs := []*Cell{
+        newCell(0, 0, 0, 4),
+        newCell(1, 1, 0, 4),
+        newCell(2, 0, 1, 4),
+        newCell(3, 1, 1, 4),
+    }
+    cs[1].ID, cs[1].Origin, cs[1].Energy, cs[1].Generation = 1, 1, 100, 5
+    cs[1].Genome = gene.Genome{gene.INC, gene.KILL, gene.STOP, gene.STOP}
+    cs[2].ID, cs[2].Origin, cs[2].Energy = 2, 2, 50
+
+    for _, name := range ColourSchemeNames() {
+        s, err := ParseColourScheme(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        img := Render(cs, 2, 2, defaultConfig, s, 3)
+        if b := img.Bounds(); b.Dx() != 6 || b.Dy() != 6 {
+            t.Fatalf("%s: unexpected bounds %v", name, b)
+        }
+        if c := img.RGBAAt(1, 1); c != black {
+            t.Errorf("%s: blank cell is %v", name, c)
+        }
+        if img.RGBAAt(3, 0) != img.RGBAAt(5, 2) {
+            t.Errorf("%s: cell is not a flat square", name)
+        }
+    }
+
+    img := Render(cs, 2, 2, defaultConfig, ColourSchemes["genotype"], 1)
+    k := cs[1].Genome.Hash()
+    want := color.RGBA{uint8(k >> 16), uint8(k >> 8), uint8(k), 255}
+    if c := img.RGBAAt(1, 0); c != want {
+        t.Errorf("genotype: expected %v, got %v", want, c)
+    }
+    if c := img.RGBAAt(0, 1); c != black {
+        t.Errorf("genotype: cell that is not viable is %v", c)
+    }
+
+    img = Render(cs, 2, 2, defaultConfig, ColourSchemes["energy"], 1)
+    if c := img.RGBAAt(1, 0); c != Heat(1) {
+        t.Errorf("energy: expected %v, got %v", Heat(1), c)
+    }
+    if c := img.RGBAAt(0, 1); c != Heat(0.5) {
+        t.Errorf("energy: expected %v, got %v", Heat(0.5), c)
+    }
+
+    if _, err := ParseColourScheme("bogus"); err == nil {
+        t.Error("expected error for invalid scheme")
+    }
+}
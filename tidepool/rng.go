@@ -3,6 +3,8 @@
 package tidepool
 
 import (
+    "fmt"
+
     "tidepool/tidepool/gene"
 )
 
@@ -26,6 +28,27 @@ var defaultRNG = DefaultRNG{
     bitsPerGene: [gene.N]int{0, 1, 1, 2, 1, 2, 2, 3, 1, 2, 2, 3, 2, 3, 3, 4},
 }
 
+// NewDefaultRNG returns the RNG used by new environments.
+func NewDefaultRNG() DefaultRNG {
+    return defaultRNG
+}
+
+func (r DefaultRNG) Validate() error {
+    if r.MutationRate < 0 || r.MutationRate > 1 {
+        return fmt.Errorf("MutationRate must be between 0 and 1, got %g",
+            r.MutationRate)
+    }
+    if r.InflowRateBase < 0 {
+        return fmt.Errorf("InflowRateBase must not be negative, got %d",
+            r.InflowRateBase)
+    }
+    if r.InflowRateModifier < 1 {
+        return fmt.Errorf("InflowRateModifier must be at least 1, got %d",
+            r.InflowRateModifier)
+    }
+    return nil
+}
+
 func (r DefaultRNG) Mutate(ctx *Context) bool {
     return ctx.rand.Float64() < r.MutationRate
 }
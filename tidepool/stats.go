@@ -2,6 +2,20 @@ package tidepool
 
 type Stats map[string]int64
 
+// IsGauge reports whether the named stat is a point-in-time value rather
+// than a cumulative counter.
+func IsGauge(name string) bool {
+    switch name {
+    case "MaxGeneration", "ViableLiveCells", "LiveCells":
+        return true
+    case "DistinctGenomes", "DistinctOrigins", "ShannonDiversityMilli",
+        "DominantGenomeHash", "DominantGenomeAbundance",
+        "MeanHammingDistance", "MeanEffectiveLength":
+        return true
+    }
+    return false
+}
+
 func (s Stats) inc(name string, i int64) {
     if v, ok := s[name]; ok {
         i = i + v
@@ -26,12 +40,20 @@ func (s Stats) Add(a Stats) {
             fallthrough
         case "MaxGeneration":
             s.update(n, i)
-        case "ViableLiveCells":
-            fallthrough
-        case "LiveCells":
-            s.set(n, i)
         default:
-            s.inc(n, i)
+            if IsGauge(n) {
+                s.set(n, i)
+            } else {
+                s.inc(n, i)
+            }
         }
     }
 }
+
+func (s Stats) Copy() Stats {
+    c := make(Stats, len(s))
+    for n, i := range s {
+        c[n] = i
+    }
+    return c
+}
@@ -0,0 +1,150 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "sort"
+    "sync"
+
+    "tidepool/tidepool/gene"
+)
+
+const maxExtinctGenotypes = 1024
+
+type Genotype struct {
+    Hash uint64
+    Genome gene.Genome
+    Abundance int64
+    FirstSeen int64
+    Peak int64
+    PeakTick int64
+    Extinct bool
+    ExtinctTick int64
+}
+
+// Tracker maintains the abundance of genotypes among viable live cells from
+// the deltas applied to the grid.
+type Tracker struct {
+    mutex sync.RWMutex
+    cells map[int32]uint64
+    genotypes map[uint64]*Genotype
+    extinct int
+}
+
+func NewTracker() *Tracker {
+    return &Tracker{
+        cells: make(map[int32]uint64),
+        genotypes: make(map[uint64]*Genotype),
+    }
+}
+
+func (t *Tracker) remove(idx int32, tick int64) {
+    h, ok := t.cells[idx]
+    if !ok {
+        return
+    }
+    delete(t.cells, idx)
+
+    g := t.genotypes[h]
+    g.Abundance--
+    if g.Abundance == 0 {
+        g.Extinct = true
+        g.ExtinctTick = tick
+        t.extinct++
+    }
+}
+
+func (t *Tracker) add(c *Cell, tick int64) {
+    h := c.Genome.Hash()
+    t.cells[c.Idx] = h
+
+    g, ok := t.genotypes[h]
+    if !ok {
+        g = &Genotype{
+            Hash: h,
+            Genome: append(gene.Genome(nil), c.Genome...),
+            FirstSeen: tick,
+        }
+        t.genotypes[h] = g
+    } else if g.Extinct {
+        g.Extinct = false
+        g.ExtinctTick = 0
+        t.extinct--
+    }
+
+    g.Abundance++
+    if g.Abundance > g.Peak {
+        g.Peak = g.Abundance
+        g.PeakTick = tick
+    }
+}
+
+// prune forgets the genotypes that went extinct earliest once too many
+// extinct genotypes are held.
+func (t *Tracker) prune() {
+    if t.extinct <= 2 * maxExtinctGenotypes {
+        return
+    }
+
+    gs := make([]*Genotype, 0, t.extinct)
+    for _, g := range t.genotypes {
+        if g.Extinct {
+            gs = append(gs, g)
+        }
+    }
+    sort.Slice(gs, func(i, j int) bool {
+        return gs[i].ExtinctTick < gs[j].ExtinctTick
+    })
+    for _, g := range gs[:len(gs) - maxExtinctGenotypes] {
+        delete(t.genotypes, g.Hash)
+        t.extinct--
+    }
+}
+
+func (t *Tracker) Apply(dt *Delta, config Config) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    tick := dt.Stats["Ticks"]
+    for _, c := range dt.Cells {
+        t.remove(c.Idx, tick)
+        if c.live() && c.viable(config) {
+            t.add(c, tick)
+        }
+    }
+    t.prune()
+}
+
+func (t *Tracker) Get(hash uint64) (Genotype, bool) {
+    t.mutex.RLock()
+    defer t.mutex.RUnlock()
+
+    if g, ok := t.genotypes[hash]; ok {
+        return *g, true
+    }
+    return Genotype{}, false
+}
+
+// Top returns up to k living genotypes ordered by abundance.
+func (t *Tracker) Top(k int) []Genotype {
+    t.mutex.RLock()
+    defer t.mutex.RUnlock()
+
+    gs := make([]Genotype, 0)
+    for _, g := range t.genotypes {
+        if !g.Extinct {
+            gs = append(gs, *g)
+        }
+    }
+    sort.Slice(gs, func(i, j int) bool {
+        if gs[i].Abundance != gs[j].Abundance {
+            return gs[i].Abundance > gs[j].Abundance
+        }
+        return gs[i].FirstSeen < gs[j].FirstSeen
+    })
+
+    if k >= 0 && len(gs) > k {
+        gs = gs[:k]
+    }
+    return gs
+}
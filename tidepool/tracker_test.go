@@ -0,0 +1,51 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "testing"
+
+    "tidepool/tidepool/gene"
+)
+
+func TestTrackerApply(t *testing.T) {
+    config := defaultConfig
+    tr := NewTracker()
+
+    cell := func(idx int32, g gene.Gene, energy int64) *Cell {
+        c := newCell(idx, idx, 0, 4)
+        c.Genome[1] = g
+        c.Energy = energy
+        c.Generation = config.ViableCellGeneration
+        return c
+    }
+    delta := func(tick int64, cs ...*Cell) *Delta {
+        return &Delta{Cells: cs, Stats: Stats{"Ticks": tick}}
+    }
+
+    tr.Apply(delta(1, cell(0, gene.INC, 1), cell(1, gene.INC, 1)), config)
+    tr.Apply(delta(2, cell(2, gene.DEC, 1)), config)
+    tr.Apply(delta(3, cell(0, gene.DEC, 1)), config)
+
+    top := tr.Top(-1)
+    if len(top) != 2 {
+        t.Fatalf("expected 2 genotypes, got %d", len(top))
+    }
+    if top[0].Genome[1] != gene.DEC || top[0].Abundance != 2 ||
+        top[0].FirstSeen != 2 || top[0].PeakTick != 3 {
+        t.Fatalf("unexpected top genotype: %+v", top[0])
+    }
+    if top[1].Abundance != 1 || top[1].Peak != 2 || top[1].PeakTick != 1 {
+        t.Fatalf("unexpected second genotype: %+v", top[1])
+    }
+
+    inc := top[1].Hash
+    tr.Apply(delta(4, cell(1, gene.INC, 0)), config)
+    g, ok := tr.Get(inc)
+    if !ok || !g.Extinct || g.ExtinctTick != 4 {
+        t.Fatalf("expected extinct genotype: %+v", g)
+    }
+    if len(tr.Top(-1)) != 1 {
+        t.Fatalf("extinct genotype listed in top")
+    }
+}
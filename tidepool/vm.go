@@ -189,6 +189,9 @@ func (vm *VM) exec(nh Neighborhood) *Delta {
     vm.cellMap.AddCell(c)
 
     stats := make(Stats)
+    if c.Energy > 0 {
+        stats.inc("Executions", 1)
+    }
 
     for c.Energy > 0 {
         g := c.Genome[vm.genomeIdx]
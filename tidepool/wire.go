@@ -0,0 +1,280 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+)
+
+// WireVersion is the first byte of every binary encoded Delta, Cell and
+// Stats.
+const WireVersion byte = 1
+
+var ErrWireVersion = errors.New("unsupported wire version")
+
+// maxFrameSize limits the frames read by ReadDelta, so that a corrupt length
+// cannot make it allocate more.
+const maxFrameSize = 1 << 28
+
+type wireWriter struct {
+    b []byte
+    l [binary.MaxVarintLen64]byte
+}
+
+func (w *wireWriter) uvarint(v uint64) {
+    w.b = append(w.b, w.l[:binary.PutUvarint(w.l[:], v)]...)
+}
+
+func (w *wireWriter) varint(v int64) {
+    w.b = append(w.b, w.l[:binary.PutVarint(w.l[:], v)]...)
+}
+
+func (w *wireWriter) string(s string) {
+    w.uvarint(uint64(len(s)))
+    w.b = append(w.b, s...)
+}
+
+func (w *wireWriter) cell(c *Cell) {
+    w.varint(int64(c.Idx))
+    w.varint(c.ID)
+    w.varint(c.Origin)
+    w.varint(c.Parent)
+    w.varint(c.Generation)
+    w.varint(c.Energy)
+    w.varint(int64(c.X))
+    w.varint(int64(c.Y))
+    w.b = c.Genome.AppendBinary(w.b)
+}
+
+// Stats are written in name order so encoding is deterministic.
+func (w *wireWriter) stats(s Stats) {
+    names := make([]string, 0, len(s))
+    for n := range s {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+
+    w.uvarint(uint64(len(names)))
+    for _, n := range names {
+        w.string(n)
+        w.varint(s[n])
+    }
+}
+
+type wireReader struct {
+    b []byte
+    err error
+}
+
+func (r *wireReader) fail(err error) {
+    if r.err == nil {
+        r.err = err
+    }
+}
+
+func (r *wireReader) uvarint() uint64 {
+    if r.err != nil {
+        return 0
+    }
+    v, n := binary.Uvarint(r.b)
+    if n <= 0 {
+        r.fail(io.ErrUnexpectedEOF)
+        return 0
+    }
+    r.b = r.b[n:]
+    return v
+}
+
+func (r *wireReader) varint() int64 {
+    if r.err != nil {
+        return 0
+    }
+    v, n := binary.Varint(r.b)
+    if n <= 0 {
+        r.fail(io.ErrUnexpectedEOF)
+        return 0
+    }
+    r.b = r.b[n:]
+    return v
+}
+
+func (r *wireReader) string() string {
+    n := r.uvarint()
+    if r.err != nil {
+        return ""
+    }
+    if uint64(len(r.b)) < n {
+        r.fail(io.ErrUnexpectedEOF)
+        return ""
+    }
+    s := string(r.b[:n])
+    r.b = r.b[n:]
+    return s
+}
+
+func (r *wireReader) version() {
+    if len(r.b) == 0 {
+        r.fail(io.ErrUnexpectedEOF)
+        return
+    }
+    if r.b[0] != WireVersion {
+        r.fail(fmt.Errorf("%w: %d", ErrWireVersion, r.b[0]))
+        return
+    }
+    r.b = r.b[1:]
+}
+
+func (r *wireReader) cell() *Cell {
+    c := &Cell{
+        Idx: int32(r.varint()),
+        ID: r.varint(),
+        Origin: r.varint(),
+        Parent: r.varint(),
+        Generation: r.varint(),
+        Energy: r.varint(),
+        X: int32(r.varint()),
+        Y: int32(r.varint()),
+    }
+    if r.err != nil {
+        return nil
+    }
+    n, err := c.Genome.ReadBinary(r.b)
+    if err != nil {
+        r.fail(err)
+        return nil
+    }
+    r.b = r.b[n:]
+    return c
+}
+
+func (r *wireReader) stats() Stats {
+    n := r.uvarint()
+    s := make(Stats)
+    for i := uint64(0); i < n && r.err == nil; i++ {
+        name := r.string()
+        s[name] = r.varint()
+    }
+    return s
+}
+
+func (c *Cell) MarshalBinary() ([]byte, error) {
+    w := &wireWriter{b: []byte{WireVersion}}
+    w.cell(c)
+    return w.b, nil
+}
+
+func (c *Cell) UnmarshalBinary(b []byte) error {
+    r := &wireReader{b: b}
+    r.version()
+    if n := r.cell(); r.err == nil {
+        *c = *n
+    }
+    return r.err
+}
+
+func (s Stats) MarshalBinary() ([]byte, error) {
+    w := &wireWriter{b: []byte{WireVersion}}
+    w.stats(s)
+    return w.b, nil
+}
+
+func (s *Stats) UnmarshalBinary(b []byte) error {
+    r := &wireReader{b: b}
+    r.version()
+    if n := r.stats(); r.err == nil {
+        *s = n
+    }
+    return r.err
+}
+
+// MarshalBinary encodes the cells and stats of the delta. The neighborhood
+// is internal to the Env and is not encoded.
+func (dt *Delta) MarshalBinary() ([]byte, error) {
+    w := &wireWriter{b: []byte{WireVersion}}
+    w.stats(dt.Stats)
+    w.uvarint(uint64(len(dt.Cells)))
+    for _, c := range dt.Cells {
+        w.cell(c)
+    }
+    return w.b, nil
+}
+
+func (dt *Delta) UnmarshalBinary(b []byte) error {
+    r := &wireReader{b: b}
+    r.version()
+    stats := r.stats()
+    n := r.uvarint()
+    if r.err != nil {
+        return r.err
+    }
+
+    cells := make([]*Cell, 0)
+    for i := uint64(0); i < n && r.err == nil; i++ {
+        cells = append(cells, r.cell())
+    }
+    if r.err != nil {
+        return r.err
+    }
+
+    dt.Stats = stats
+    dt.Cells = cells
+    dt.Neighborhood = Neighborhood{}
+
+    return nil
+}
+
+// WriteDelta writes dt to w as a binary frame prefixed by its length.
+func WriteDelta(w io.Writer, dt *Delta) error {
+    b, err := dt.MarshalBinary()
+    if err != nil {
+        return err
+    }
+    return writeFrame(w, b)
+}
+
+// ReadDelta reads a frame written by WriteDelta.
+func ReadDelta(r *bufio.Reader) (*Delta, error) {
+    b, err := readFrame(r)
+    if err != nil {
+        return nil, err
+    }
+    dt := &Delta{}
+    if err := dt.UnmarshalBinary(b); err != nil {
+        return nil, err
+    }
+    return dt, nil
+}
+
+func writeFrame(w io.Writer, b []byte) error {
+    var l [binary.MaxVarintLen64]byte
+    if _, err := w.Write(l[:binary.PutUvarint(l[:], uint64(len(b)))]); err != nil {
+        return err
+    }
+    _, err := w.Write(b)
+    return err
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+    n, err := binary.ReadUvarint(r)
+    if err != nil {
+        return nil, err
+    }
+    if n > maxFrameSize {
+        return nil, fmt.Errorf("frame of %d bytes exceeds %d", n, maxFrameSize)
+    }
+    // The buffer grows as data arrives rather than trusting n.
+    var buf bytes.Buffer
+    if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
@@ -0,0 +1,84 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package tidepool
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func TestDeltaBinaryRoundTrip(t *testing.T) {
+    env, err := NewEnv(4, 4, 7, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx := newContext(env)
+    cells, _ := env.GetCells()
+    for i, c := range cells[:3] {
+        c.ID = int64(i + 1)
+        c.Energy = int64(i * 100)
+        c.Generation = -1
+        c.randomizeGenome(ctx)
+    }
+
+    dt := &Delta{
+        Cells: cells[:3],
+        Stats: Stats{"Ticks": 42, "Mutations": -3},
+    }
+
+    var buf bytes.Buffer
+    if err := WriteDelta(&buf, dt); err != nil {
+        t.Fatal(err)
+    }
+    if err := WriteDelta(&buf, dt); err != nil {
+        t.Fatal(err)
+    }
+
+    r := bufio.NewReader(&buf)
+    for i := 0; i < 2; i++ {
+        got, err := ReadDelta(r)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(got.Cells, dt.Cells) ||
+            !reflect.DeepEqual(got.Stats, dt.Stats) {
+            t.Fatalf("round trip mismatch: %+v", got)
+        }
+    }
+
+    b, _ := dt.MarshalBinary()
+    b[0] = WireVersion + 1
+    if err := (&Delta{}).UnmarshalBinary(b); !errors.Is(err, ErrWireVersion) {
+        t.Fatalf("expected version error, got %v", err)
+    }
+}
+
+func TestReadDeltaMalformed(t *testing.T) {
+    for _, b := range [][]byte{
+        // Frame longer than the limit.
+        {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+        // Frame longer than the data.
+        {0x10, WireVersion},
+        // Many cells and no data for them.
+        {0x04, WireVersion, 0x00, 0xff, 0x7f},
+    } {
+        if _, err := ReadDelta(bufio.NewReader(bytes.NewReader(b))); err == nil {
+            t.Errorf("% x: expected error", b)
+        }
+    }
+}
+
+func FuzzDeltaUnmarshalBinary(f *testing.F) {
+    dt := &Delta{
+        Cells: []*Cell{newCell(1, 1, 0, 4)},
+        Stats: Stats{"Ticks": 1},
+    }
+    b, _ := dt.MarshalBinary()
+    f.Add(b)
+    f.Fuzz(func(t *testing.T, b []byte) {
+        (&Delta{}).UnmarshalBinary(b)
+    })
+}
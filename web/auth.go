@@ -0,0 +1,204 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "bufio"
+    "crypto/subtle"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+)
+
+const tokenCookie = "tidepool_token"
+
+var (
+    errNoToken = errors.New("missing token")
+    errBadToken = errors.New("invalid token")
+)
+
+var roles = map[string]Role{
+    "viewer": RoleViewer,
+    "operator": RoleOperator,
+}
+
+func ParseRole(s string) (Role, error) {
+    if r, ok := roles[s]; ok {
+        return r, nil
+    }
+    return 0, fmt.Errorf("invalid role: %s", s)
+}
+
+type token struct {
+    value []byte
+    role Role
+}
+
+// Auth authenticates requests by static tokens. A token is taken from an
+// "Authorization: Bearer" header, a token query parameter or a cookie set
+// when the query parameter was last used, so that pages opened with
+// ?token= can reach the other endpoints and the websocket.
+type Auth struct {
+    tokens []token
+}
+
+// LoadAuth reads tokens from a file with one "token role" pair per line.
+// Empty lines and lines starting with # are ignored.
+func LoadAuth(path string) (*Auth, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    a := &Auth{}
+    s := bufio.NewScanner(f)
+    for n := 1; s.Scan(); n++ {
+        line := strings.TrimSpace(s.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        fields := strings.Fields(line)
+        if len(fields) != 2 {
+            return nil, fmt.Errorf("%s:%d: expected token and role", path, n)
+        }
+        role, err := ParseRole(fields[1])
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+        }
+        a.tokens = append(a.tokens, token{[]byte(fields[0]), role})
+    }
+    if err := s.Err(); err != nil {
+        return nil, err
+    }
+    if len(a.tokens) == 0 {
+        return nil, fmt.Errorf("%s: no tokens", path)
+    }
+
+    return a, nil
+}
+
+func requestToken(r *http.Request) (string, bool) {
+    if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+        return strings.TrimPrefix(h, "Bearer "), false
+    }
+    if t := r.URL.Query().Get("token"); t != "" {
+        return t, true
+    }
+    if c, err := r.Cookie(tokenCookie); err == nil {
+        return c.Value, false
+    }
+    return "", false
+}
+
+func (a *Auth) lookup(t string) (Role, bool) {
+    var role Role
+    found := false
+    // Compare with every token in constant time.
+    for _, tok := range a.tokens {
+        if subtle.ConstantTimeCompare(tok.value, []byte(t)) == 1 {
+            role, found = tok.role, true
+        }
+    }
+    return role, found
+}
+
+// Role returns the role of the token of r.
+func (a *Auth) Role(r *http.Request) (Role, error) {
+    t, _ := requestToken(r)
+    if t == "" {
+        return 0, errNoToken
+    }
+    role, ok := a.lookup(t)
+    if !ok {
+        return 0, errBadToken
+    }
+    return role, nil
+}
+
+// Require returns a handler that serves requests whose token has at least the
+// given role with h, like Options.Require with a. A nil Auth permits every
+// request.
+func (a *Auth) Require(role Role, h http.Handler) http.Handler {
+    if a == nil {
+        return h
+    }
+    o := &Options{Auth: a}
+    return o.Require(role, h)
+}
+
+// role returns the role of the client making r: the role of its token if
+// authentication is enabled, otherwise the role in the options, which is
+// RoleViewer unless operators were explicitly permitted without tokens.
+func (o *Options) role(r *http.Request) (Role, error) {
+    if o.Auth == nil {
+        return o.Role, nil
+    }
+    return o.Auth.Role(r)
+}
+
+// Require returns a handler that serves requests of clients with at least the
+// given role with h. Without authentication, requests are served with the
+// role in the options.
+func (o *Options) Require(role Role, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if o.authorize(w, r, role) {
+            h.ServeHTTP(w, r)
+        }
+    })
+}
+
+// authorize writes an error and returns false unless the client making r has
+// at least the given role. A token given in the query is kept in a cookie so
+// that later requests of the page need not repeat it.
+func (o *Options) authorize(w http.ResponseWriter, r *http.Request, role Role) bool {
+    got, err := o.role(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return false
+    }
+    if got < role {
+        http.Error(w, errPermission.Error(), http.StatusForbidden)
+        return false
+    }
+    if o.Auth != nil {
+        if t, query := requestToken(r); query {
+            http.SetCookie(w, &http.Cookie{
+                Name: tokenCookie,
+                Value: t,
+                Path: "/",
+                HttpOnly: true,
+                SameSite: http.SameSiteStrictMode,
+            })
+        }
+    }
+    return true
+}
+
+// checkOrigin permits websocket connections from the origins in allowed, or
+// from the host of the request if allowed is empty. "*" permits any origin.
+func checkOrigin(allowed []string) func(*http.Request) bool {
+    return func(r *http.Request) bool {
+        origin := r.Header.Get("Origin")
+        if origin == "" {
+            return true
+        }
+        u, err := url.Parse(origin)
+        if err != nil {
+            return false
+        }
+        if len(allowed) == 0 {
+            return strings.EqualFold(u.Host, r.Host)
+        }
+        for _, a := range allowed {
+            if a == "*" || strings.EqualFold(a, origin) ||
+                strings.EqualFold(a, u.Host) {
+                return true
+            }
+        }
+        return false
+    }
+}
@@ -0,0 +1,109 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestAuth(t *testing.T) {
+    dir, err := ioutil.TempDir("", "auth")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "tokens")
+    data := "# tokens\nview viewer\n\nop operator\n"
+    if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+        t.Fatal(err)
+    }
+    auth, err := LoadAuth(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    h := auth.Require(RoleOperator, http.HandlerFunc(
+        func(w http.ResponseWriter, r *http.Request) {}))
+    for _, c := range []struct {
+        token string
+        header bool
+        code int
+    }{
+        {"", false, http.StatusUnauthorized},
+        {"bogus", true, http.StatusUnauthorized},
+        {"view", true, http.StatusForbidden},
+        {"op", true, http.StatusOK},
+        {"op", false, http.StatusOK},
+    } {
+        r := httptest.NewRequest("GET", "/", nil)
+        if c.header {
+            r.Header.Set("Authorization", "Bearer " + c.token)
+        } else if c.token != "" {
+            r = httptest.NewRequest("GET", "/?token=" + c.token, nil)
+        }
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+        if w.Code != c.code {
+            t.Errorf("token %q: expected %d, got %d", c.token, c.code, w.Code)
+        }
+        if !c.header && c.token != "" && len(w.Result().Cookies()) != 1 {
+            t.Errorf("token %q: expected cookie", c.token)
+        }
+    }
+
+    if err := ioutil.WriteFile(path, []byte("op admin\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := LoadAuth(path); err == nil {
+        t.Error("expected error for invalid role")
+    }
+}
+
+func TestCheckOrigin(t *testing.T) {
+    r := httptest.NewRequest("GET", "http://example.com/ws", nil)
+    for _, c := range []struct {
+        allowed []string
+        origin string
+        ok bool
+    }{
+        {nil, "", true},
+        {nil, "http://example.com", true},
+        {nil, "http://evil.com", false},
+        {[]string{"viewer.com"}, "https://viewer.com", true},
+        {[]string{"https://viewer.com"}, "http://example.com", false},
+        {[]string{"*"}, "http://evil.com", true},
+    } {
+        r.Header.Set("Origin", c.origin)
+        if checkOrigin(c.allowed)(r) != c.ok {
+            t.Errorf("%v %q: expected %v", c.allowed, c.origin, c.ok)
+        }
+    }
+}
+
+func TestOptionsRequire(t *testing.T) {
+    h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+    opts := DefaultOptions
+    for _, c := range []struct {
+        role, required Role
+        code int
+    }{
+        {RoleViewer, RoleViewer, http.StatusOK},
+        {RoleViewer, RoleOperator, http.StatusForbidden},
+        {RoleOperator, RoleOperator, http.StatusOK},
+    } {
+        opts.Role = c.role
+        w := httptest.NewRecorder()
+        opts.Require(c.required, h).ServeHTTP(w,
+            httptest.NewRequest("PUT", "/config", nil))
+        if w.Code != c.code {
+            t.Errorf("role %d requiring %d: expected %d, got %d", c.role,
+                c.required, c.code, w.Code)
+        }
+    }
+}
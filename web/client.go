@@ -0,0 +1,231 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// SlowClientPolicy decides what happens to a message when a client's queue
+// is full.
+type SlowClientPolicy int
+
+const (
+    // The message is dropped and the client is sent a new snapshot once its
+    // queue has drained.
+    SlowClientResync SlowClientPolicy = iota
+    // The message is dropped; clients detect the gap in sequence numbers and
+    // request a resync themselves.
+    SlowClientDrop
+    // The client is disconnected.
+    SlowClientDisconnect
+)
+
+var slowClientPolicies = map[string]SlowClientPolicy{
+    "resync": SlowClientResync,
+    "drop": SlowClientDrop,
+    "disconnect": SlowClientDisconnect,
+}
+
+func ParseSlowClientPolicy(s string) (SlowClientPolicy, error) {
+    if p, ok := slowClientPolicies[s]; ok {
+        return p, nil
+    }
+    return 0, fmt.Errorf("invalid slow client policy: %s", s)
+}
+
+// Role decides which client messages are permitted.
+type Role int
+
+const (
+    // Viewers may only change what they receive.
+    RoleViewer Role = iota
+    // Operators may also control the env.
+    RoleOperator
+)
+
+type Options struct {
+    // Number of messages queued per client.
+    QueueSize int
+    // Number of consecutive dropped messages after which a client is
+    // disconnected; 0 never disconnects.
+    MaxDropped int
+    SlowClient SlowClientPolicy
+    WriteTimeout time.Duration
+    // Clients that do not answer pings within PongTimeout are disconnected,
+    // as are polling clients that do not poll within PongTimeout.
+    PongTimeout time.Duration
+    // Longest time a poll waits for messages.
+    PollTimeout time.Duration
+    // Number of cells whose parent is remembered for lineage queries.
+    LineageSize int
+    // Role of clients if Auth is nil. Clients may only control the env
+    // without authentication if this is set to RoleOperator.
+    Role Role
+    // Authenticates clients by token if not nil.
+    Auth *Auth
+    // Origins permitted to open websockets; empty permits the host of the
+    // server only.
+    Origins []string
+}
+
+var DefaultOptions = Options{
+    QueueSize: 16,
+    MaxDropped: 64,
+    SlowClient: SlowClientResync,
+    WriteTimeout: 10 * time.Second,
+    PongTimeout: 60 * time.Second,
+    PollTimeout: 25 * time.Second,
+    LineageSize: 1 << 20,
+    Role: RoleViewer,
+}
+
+type client struct {
+    ch chan []byte
+    // Nil for clients served over SSE or polling, which are disconnected by
+    // closing quit instead.
+    socket *websocket.Conn
+    quit chan struct{}
+    quitOnce sync.Once
+    binary bool
+    role Role
+
+    // Only accessed by the fan-out loop.
+    sub Subscription
+    dropped int
+    resync bool
+}
+
+// deliver queues msg for cl without blocking. It reports whether the message
+// was queued.
+func (c *Conn) deliver(cl *client, msg []byte) bool {
+    select {
+    case cl.ch <- msg:
+        cl.dropped = 0
+        return true
+    default:
+    }
+
+    atomic.AddInt64(&c.dropped, 1)
+    cl.dropped++
+
+    if c.options.SlowClient == SlowClientDisconnect ||
+        (c.options.MaxDropped > 0 && cl.dropped >= c.options.MaxDropped) {
+        cl.disconnect()
+    } else if c.options.SlowClient == SlowClientResync {
+        cl.resync = true
+    }
+
+    return false
+}
+
+// disconnect makes the handler of cl fail and remove it.
+func (cl *client) disconnect() {
+    if cl.socket != nil {
+        cl.socket.Close()
+        return
+    }
+    cl.quitOnce.Do(func() { close(cl.quit) })
+}
+
+// Dropped returns the number of messages dropped for slow clients.
+func (c *Conn) Dropped() int64 {
+    return atomic.LoadInt64(&c.dropped)
+}
+
+func (c *Conn) writeLoop(cl *client) {
+    s := cl.socket
+    mt := websocket.TextMessage
+    if cl.binary {
+        mt = websocket.BinaryMessage
+    }
+
+    ping := time.NewTicker(c.options.PongTimeout * 9 / 10)
+    defer ping.Stop()
+
+    for {
+        select {
+        case msg, ok := <-cl.ch:
+            if !ok {
+                s.WriteControl(websocket.CloseMessage, nil,
+                    time.Now().Add(c.options.WriteTimeout))
+                return
+            }
+            s.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+            if err := s.WriteMessage(mt, msg); err != nil {
+                s.Close()
+                return
+            }
+        case <-ping.C:
+            err := s.WriteControl(websocket.PingMessage, nil,
+                time.Now().Add(c.options.WriteTimeout))
+            if err != nil {
+                s.Close()
+                return
+            }
+        }
+    }
+}
+
+func (c *Conn) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+    role, err := c.options.role(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return
+    }
+
+    s, err := c.upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    defer s.Close()
+
+    q := r.URL.Query()
+    sub, err := parseSubscription(q, c.env.Width, c.env.Height)
+    if err != nil {
+        s.WriteControl(websocket.CloseMessage,
+            websocket.FormatCloseMessage(websocket.ClosePolicyViolation,
+                err.Error()), time.Now().Add(c.options.WriteTimeout))
+        return
+    }
+
+    cl := &client{
+        ch: make(chan []byte, c.options.QueueSize),
+        socket: s,
+        binary: q.Get("format") == "binary",
+        role: role,
+        sub: sub,
+    }
+    id := c.addChannel(cl)
+    defer c.delChannel(id)
+
+    go c.writeLoop(cl)
+    c.requestSnapshot(id, nil)
+
+    s.SetReadDeadline(time.Now().Add(c.options.PongTimeout))
+    s.SetPongHandler(func(string) error {
+        return s.SetReadDeadline(time.Now().Add(c.options.PongTimeout))
+    })
+
+    for {
+        _, b, err := s.ReadMessage()
+        if err != nil {
+            return
+        }
+        var msg ClientMsg
+        var result interface{}
+        if err = json.Unmarshal(b, &msg); err == nil {
+            result, err = c.handleMsg(id, cl, r.RemoteAddr, msg)
+        }
+        c.reply(id, msg.ID, result, err)
+    }
+}
@@ -0,0 +1,81 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "encoding/json"
+    "net/url"
+    "testing"
+
+    tp "tidepool/tidepool"
+    "tidepool/tidepool/gene"
+)
+
+func TestDeliverSlowClient(t *testing.T) {
+    c := &Conn{options: DefaultOptions}
+    cl := &client{ch: make(chan []byte, 1)}
+
+    if !c.deliver(cl, []byte("a")) {
+        t.Fatal("expected message to be queued")
+    }
+    if c.deliver(cl, []byte("b")) {
+        t.Fatal("expected message to be dropped")
+    }
+    if !cl.resync || cl.dropped != 1 || c.Dropped() != 1 {
+        t.Fatalf("unexpected client state: resync %v, dropped %d/%d",
+            cl.resync, cl.dropped, c.Dropped())
+    }
+
+    <-cl.ch
+    if !c.deliver(cl, []byte("c")) || cl.dropped != 0 {
+        t.Fatal("expected drained client to accept messages")
+    }
+}
+
+func TestSnapshotFromShadow(t *testing.T) {
+    env, err := tp.NewEnv(4, 4, 8, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := NewConn(env, nil, nil, tp.NewHistory(10, 4, 1, 2), DefaultOptions)
+    g := gene.Genome{gene.ZERO, gene.INC, gene.STOP, gene.STOP,
+        gene.STOP, gene.STOP, gene.STOP, gene.STOP}
+    cell := &tp.Cell{Idx: 6, X: 2, Y: 1, ID: 1, Origin: 1, Energy: 100,
+        Genome: g}
+    c.shadow.update([]*tp.Cell{cell}, &colourContext{}, false)
+
+    sub, err := parseSubscription(url.Values{"detail": {"full"}}, 4, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, err := c.encodeSnapshot(sub, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var msg SnapshotMsg
+    if err := json.Unmarshal(b, &msg); err != nil {
+        t.Fatal(err)
+    }
+    if len(msg.Cells) != 1 || msg.Cells[0].Genome.String() != g.String() {
+        t.Fatalf("expected the cell and its genome, got %+v", msg.Cells)
+    }
+
+    cs := c.shadow.viewport(sub, 4)
+    if len(cs) != 16 || cs[6].Energy != 100 || cs[6].X != 2 ||
+        cs[5].Genome.String() != "........" {
+        t.Fatalf("unexpected viewport %v", cs)
+    }
+
+    if idx, ok := c.shadow.lookup(1); !ok || idx != 6 {
+        t.Fatalf("expected cell 1 at 6, got %d, %v", idx, ok)
+    }
+    child := &tp.Cell{Idx: 6, X: 2, Y: 1, ID: 2, Origin: 1, Energy: 50,
+        Genome: g}
+    c.shadow.update([]*tp.Cell{child}, &colourContext{}, false)
+    if _, ok := c.shadow.lookup(1); ok {
+        t.Error("replaced cell still indexed")
+    }
+    if idx, ok := c.shadow.lookup(2); !ok || idx != 6 {
+        t.Errorf("expected cell 2 at 6, got %d, %v", idx, ok)
+    }
+}
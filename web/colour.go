@@ -0,0 +1,187 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "hash/fnv"
+    "math/bits"
+    "strconv"
+
+    tp "tidepool/tidepool"
+)
+
+// Colour modes select what the colour of a cell shows. In the genotype mode
+// clients colour cells by their Key; in every other mode the server sends a
+// Colour index into the palette of the mode, which is advertised by /env.
+// Index 0 is black and used for cells that are not live.
+const (
+    ColourGenotype = "genotype"
+    // A colour per Origin, shared by cells descended from the same inflow.
+    ColourOrigin = "origin"
+    // Generation on a logarithmic scale.
+    ColourGeneration = "generation"
+    // Energy on a logarithmic scale.
+    ColourEnergy = "energy"
+    // Rank of the genotype by abundance; unranked live cells are grey.
+    ColourRank = "rank"
+    // Ticks since the cell was last executed on a logarithmic scale, with
+    // recently executed cells brightest.
+    ColourExec = "exec"
+)
+
+// Modes with a palette, in the order of cellState.Palette.
+var paletteModes = [...]string{
+    ColourOrigin, ColourGeneration, ColourEnergy, ColourRank, ColourExec,
+}
+
+const (
+    heatLevels = 16
+    originColours = 64
+    rankedGenotypes = 14
+    // Palettes of unchanged cells, which depend on time and genotype ranks,
+    // are refreshed every paletteRefresh broadcasts.
+    paletteRefresh = 8
+)
+
+type ColourMode struct {
+    Name string
+    // RGB colours indexed by the Colour field of cells.
+    Palette []uint32 `json:",omitempty"`
+}
+
+var rankColours = [rankedGenotypes]uint32{
+    0x1f77b4, 0xff7f0e, 0x2ca02c, 0xd62728, 0x9467bd, 0x8c564b, 0xe377c2,
+    0xbcbd22, 0x17becf, 0xaec7e8, 0xffbb78, 0x98df8a, 0xff9896, 0xc5b0d5,
+}
+
+func rgb(r, g, b uint8) uint32 {
+    return uint32(r) << 16 | uint32(g) << 8 | uint32(b)
+}
+
+func heatPalette() []uint32 {
+    p := make([]uint32, heatLevels)
+    for i := 1; i < heatLevels; i++ {
+        c := tp.Heat(float64(i) / float64(heatLevels - 1))
+        p[i] = rgb(c.R, c.G, c.B)
+    }
+    return p
+}
+
+func originPalette() []uint32 {
+    p := make([]uint32, originColours)
+    for i := 1; i < originColours; i++ {
+        h := fnv.New32a()
+        h.Write([]byte(strconv.Itoa(i)))
+        p[i] = h.Sum32() & 0xffffff
+    }
+    return p
+}
+
+func rankPalette() []uint32 {
+    p := make([]uint32, rankedGenotypes + 2)
+    p[1] = 0x606060
+    copy(p[2:], rankColours[:])
+    return p
+}
+
+// ColourModes lists the colour modes and their palettes.
+var ColourModes = []ColourMode{
+    {Name: ColourGenotype},
+    {Name: ColourOrigin, Palette: originPalette()},
+    {Name: ColourGeneration, Palette: heatPalette()},
+    {Name: ColourEnergy, Palette: heatPalette()},
+    {Name: ColourRank, Palette: rankPalette()},
+    {Name: ColourExec, Palette: heatPalette()},
+}
+
+// paletteMode returns the index of mode in cellState.Palette, or -1 if it has
+// no palette.
+func paletteMode(mode string) int {
+    for i, m := range paletteModes {
+        if m == mode {
+            return i
+        }
+    }
+    return -1
+}
+
+func validColourMode(mode string) bool {
+    return mode == ColourGenotype || paletteMode(mode) >= 0
+}
+
+// logLevel maps v >= 0 to a heat palette index of at least 1.
+func logLevel(v int64) uint8 {
+    l := bits.Len64(uint64(v)) + 1
+    if l >= heatLevels {
+        l = heatLevels - 1
+    }
+    return uint8(l)
+}
+
+// colourContext holds what palette indices depend on besides the cell.
+type colourContext struct {
+    tick int64
+    // Tick at which each cell was last executed.
+    lastExec []int64
+    // Rank palette index by colour key.
+    ranks map[uint32]uint8
+}
+
+func (c *Conn) newColourContext(tick int64, lastExec []int64) *colourContext {
+    ranks := make(map[uint32]uint8)
+    for i, g := range c.tracker.Top(rankedGenotypes) {
+        ranks[colourKey(g.Genome)] = uint8(i + 2)
+    }
+    return &colourContext{
+        tick: tick,
+        lastExec: lastExec,
+        ranks: ranks,
+    }
+}
+
+func originColour(origin int64) uint8 {
+    h := fnv.New32a()
+    h.Write([]byte(strconv.FormatInt(origin, 10)))
+    return uint8(1 + h.Sum32() % (originColours - 1))
+}
+
+func (cc *colourContext) palette(idx int32, s cellState) (p [len(paletteModes)]uint8) {
+    if s.Energy == 0 {
+        return p
+    }
+
+    p[0] = s.originColour
+
+    p[1] = logLevel(s.Generation)
+    p[2] = logLevel(s.Energy)
+
+    p[3] = 1
+    if r, ok := cc.ranks[s.Key]; ok {
+        p[3] = r
+    }
+
+    age := cc.tick
+    if cc.lastExec != nil && cc.lastExec[idx] > 0 {
+        age -= cc.lastExec[idx]
+    }
+    p[4] = heatLevels - logLevel(age)
+
+    return p
+}
+
+// withColour returns the diffs in ds relevant to clients of the given colour
+// mode, with Colour set where the palette index of the mode changed.
+func withColour(ds []CellDiff, mode string) []CellDiff {
+    m := paletteMode(mode)
+    n := make([]CellDiff, 0, len(ds))
+    for _, d := range ds {
+        if m >= 0 && d.paletteChanged & (1 << uint(m)) != 0 {
+            v := d.palette[m]
+            d.Colour = &v
+        } else if !d.fieldsChanged {
+            continue
+        }
+        n = append(n, d)
+    }
+    return n
+}
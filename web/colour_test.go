@@ -0,0 +1,55 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "testing"
+
+    tp "tidepool/tidepool"
+    "tidepool/tidepool/gene"
+)
+
+func TestColourDiffs(t *testing.T) {
+    env, err := tp.NewEnv(4, 4, 8, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sh := newShadow(env)
+    lastExec := make([]int64, 16)
+
+    cell := &tp.Cell{Idx: 5, X: 1, Y: 1, ID: 1, Origin: 1, Energy: 100,
+        Genome: make(gene.Genome, 8)}
+    lastExec[5] = 10
+    cc := &colourContext{tick: 10, lastExec: lastExec}
+
+    ds := sh.update([]*tp.Cell{cell}, cc, false)
+    if len(ds) != 1 || !ds[0].fieldsChanged {
+        t.Fatalf("expected a single changed cell, got %v", ds)
+    }
+    ds = withColour(ds, ColourExec)
+    if ds[0].Colour == nil || *ds[0].Colour != heatLevels - 1 {
+        t.Fatalf("expected brightest exec colour, got %v", ds[0].Colour)
+    }
+
+    // Only the time since the last execution changes, which is only sent
+    // when palettes are refreshed.
+    cc = &colourContext{tick: 1000, lastExec: lastExec}
+    if ds = sh.update(nil, cc, false); len(ds) != 0 {
+        t.Fatalf("expected no diffs without refresh, got %v", ds)
+    }
+    ds = sh.update(nil, cc, true)
+    if len(ds) != 1 || ds[0].fieldsChanged {
+        t.Fatalf("expected a palette change only, got %v", ds)
+    }
+    if g := withColour(ds, ColourGenotype); len(g) != 0 {
+        t.Fatalf("expected no diffs in genotype mode, got %v", g)
+    }
+    if g := withColour(ds, ColourEnergy); len(g) != 0 {
+        t.Fatalf("expected no diffs in energy mode, got %v", g)
+    }
+    e := withColour(ds, ColourExec)
+    if len(e) != 1 || e[0].Colour == nil || *e[0].Colour >= heatLevels - 1 ||
+        e[0].Energy != nil {
+        t.Fatalf("unexpected exec diff: %v", e)
+    }
+}
@@ -0,0 +1,180 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    tp "tidepool/tidepool"
+)
+
+const maxAuditEntries = 256
+
+var errCustomRNG = errors.New("env does not use the default RNG")
+
+type badRequestError struct {
+    error
+}
+
+type AuditEntry struct {
+    Time time.Time
+    Remote string
+    Resource string
+    Old interface{}
+    New interface{}
+}
+
+// audit records changes made through the configuration endpoints.
+type audit struct {
+    mutex sync.Mutex
+    entries []AuditEntry
+}
+
+func (a *audit) add(e AuditEntry) {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    old, _ := json.Marshal(e.Old)
+    new, _ := json.Marshal(e.New)
+    log.Printf("%s changed %s from %s to %s", e.Remote, e.Resource, old, new)
+
+    a.entries = append(a.entries, e)
+    if len(a.entries) > maxAuditEntries {
+        a.entries = a.entries[len(a.entries) - maxAuditEntries:]
+    }
+}
+
+func (a *audit) list() []AuditEntry {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    return append([]AuditEntry(nil), a.entries...)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+// decodeUpdate decodes r over v, so fields missing from r keep their current
+// values.
+func decodeUpdate(r io.Reader, v interface{}) error {
+    dec := json.NewDecoder(r)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        return badRequestError{err}
+    }
+    return nil
+}
+
+func writeUpdateError(w http.ResponseWriter, err error) {
+    var bad badRequestError
+    switch {
+    case errors.As(err, &bad):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case err == errCustomRNG:
+        http.Error(w, err.Error(), http.StatusNotImplemented)
+    default:
+        http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    }
+}
+
+func (c *Conn) updateConfig(remote string, f func(*tp.Config) error) (tp.Config, error) {
+    c.configMutex.Lock()
+    defer c.configMutex.Unlock()
+
+    old := c.env.GetConfig()
+    config := old
+    if err := f(&config); err != nil {
+        return old, err
+    }
+    if err := c.env.SetConfig(config); err != nil {
+        return old, err
+    }
+    c.audit.add(AuditEntry{time.Now(), remote, "config", old, config})
+
+    return config, nil
+}
+
+func (c *Conn) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        writeJSON(w, c.env.GetConfig())
+    case http.MethodPut:
+        if !c.options.authorize(w, r, RoleOperator) {
+            return
+        }
+        config, err := c.updateConfig(r.RemoteAddr, func(config *tp.Config) error {
+            return decodeUpdate(r.Body, config)
+        })
+        if err != nil {
+            writeUpdateError(w, err)
+            return
+        }
+        writeJSON(w, config)
+    default:
+        w.Header().Set("Allow", "GET, PUT")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func (c *Conn) updateRNG(remote string, f func(*tp.DefaultRNG) error) (tp.DefaultRNG, error) {
+    c.configMutex.Lock()
+    defer c.configMutex.Unlock()
+
+    old, ok := c.env.GetRNG().(tp.DefaultRNG)
+    if !ok {
+        return old, errCustomRNG
+    }
+    rng := old
+    if err := f(&rng); err != nil {
+        return old, err
+    }
+    if err := c.env.SetRNG(rng); err != nil {
+        return old, err
+    }
+    c.audit.add(AuditEntry{time.Now(), remote, "rng", old, rng})
+
+    return rng, nil
+}
+
+func (c *Conn) RNGHandler(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        rng, ok := c.env.GetRNG().(tp.DefaultRNG)
+        if !ok {
+            http.Error(w, errCustomRNG.Error(), http.StatusNotImplemented)
+            return
+        }
+        writeJSON(w, rng)
+    case http.MethodPut:
+        if !c.options.authorize(w, r, RoleOperator) {
+            return
+        }
+        rng, err := c.updateRNG(r.RemoteAddr, func(rng *tp.DefaultRNG) error {
+            return decodeUpdate(r.Body, rng)
+        })
+        if err != nil {
+            writeUpdateError(w, err)
+            return
+        }
+        writeJSON(w, rng)
+    default:
+        w.Header().Set("Allow", "GET, PUT")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// AuditHandler lists the recent changes to the env. It requires an operator,
+// since the entries name the clients that made them.
+func (c *Conn) AuditHandler(w http.ResponseWriter, r *http.Request) {
+    if !c.options.authorize(w, r, RoleOperator) {
+        return
+    }
+    writeJSON(w, c.audit.list())
+}
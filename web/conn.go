@@ -3,9 +3,12 @@
 package web
 
 import (
+    "context"
     "encoding/json"
+    "fmt"
     "log"
     "net/http"
+    "strconv"
     "sync"
     "time"
 
@@ -16,83 +19,145 @@ import (
 
 type Conn struct {
     env *tp.Env
-    stats tp.Stats
-    cellMap tp.CellMap
-    request chan int
+    options Options
+    history *tp.History
+    tracker *tp.Tracker
+    lineage *tp.Lineage
+    audit *audit
+    configMutex *sync.Mutex
     deltas <-chan *tp.Delta
     update <-chan time.Time
+    request chan request
+    // done is closed once deltas is closed, closed by Close.
+    done chan struct{}
+    closed chan struct{}
+    closeOnce sync.Once
+    dropped int64
+
+    // Guards the state accumulated from deltas.
+    deltaMutex *sync.Mutex
+    stats tp.Stats
+    cellMap tp.CellMap
+    lastExec []int64
+
+    // Only accessed by the fan-out loop, but for shadow.lookup.
+    shadow *shadow
+    execBuf []int64
+    lastStats tp.Stats
+    seq int64
 
     upgrader websocket.Upgrader
     mutex *sync.RWMutex
-    channels map[int]chan []byte
+    channels map[int]*client
     nextID int
+
+    sessionMutex *sync.Mutex
+    sessions map[string]*pollSession
+}
+
+type request struct {
+    id int
+    sub *Subscription
+    colour string
+}
+
+type GenotypeJSON struct {
+    tp.Genotype
+    Disassembly []string
 }
 
 type EnvJSON struct {
     Width int32
     Height int32
     ViableCellGeneration int64
+    ColourModes []ColourMode
 }
 
-func NewConn(e *tp.Env, d <-chan *tp.Delta, u <-chan time.Time) *Conn {
+func NewConn(e *tp.Env, d <-chan *tp.Delta, u <-chan time.Time,
+    h *tp.History, o Options) *Conn {
     return &Conn{
         env: e,
-        stats: make(tp.Stats),
-        cellMap: make(tp.CellMap),
-        request: make(chan int),
+        options: o,
+        history: h,
+        tracker: tp.NewTracker(),
+        lineage: tp.NewLineage(o.LineageSize),
+        audit: &audit{},
+        configMutex: &sync.Mutex{},
         deltas: d,
         update: u,
+        request: make(chan request),
+        done: make(chan struct{}),
+        closed: make(chan struct{}),
+
+        deltaMutex: &sync.Mutex{},
+        stats: make(tp.Stats),
+        cellMap: make(tp.CellMap),
+        lastExec: make([]int64, e.Width * e.Height),
 
-        upgrader: websocket.Upgrader{},
+        shadow: newShadow(e),
+        execBuf: make([]int64, e.Width * e.Height),
+        lastStats: make(tp.Stats),
+
+        upgrader: websocket.Upgrader{CheckOrigin: checkOrigin(o.Origins)},
         mutex: &sync.RWMutex{},
-        channels: make(map[int]chan []byte),
+        channels: make(map[int]*client),
+
+        sessionMutex: &sync.Mutex{},
+        sessions: make(map[string]*pollSession),
     }
 }
 
-func (c *Conn) addChannel(ch chan []byte) int {
+func (c *Conn) addChannel(cl *client) int {
     c.mutex.Lock()
     id := c.nextID
     c.nextID++
-    c.channels[id] = ch
+    c.channels[id] = cl
     c.mutex.Unlock()
     return id
 }
 
 func (c *Conn) delChannel(id int) {
     c.mutex.Lock()
-    close(c.channels[id])
-    delete(c.channels, id)
+    if cl, ok := c.channels[id]; ok {
+        close(cl.ch)
+        delete(c.channels, id)
+    }
     c.mutex.Unlock()
 }
 
+// Close disconnects every client and makes Run return.
 func (c *Conn) Close() {
+    c.closeOnce.Do(func() { close(c.closed) })
     c.mutex.Lock()
-    for _, ch := range c.channels {
-        close(ch)
+    for id, cl := range c.channels {
+        close(cl.ch)
+        delete(c.channels, id)
     }
     c.mutex.Unlock()
 }
 
-func (c *Conn) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
-    s, err := c.upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        log.Println(err)
-        return
-    }
-    defer s.Close()
+func (c *Conn) Clients() int {
+    c.mutex.RLock()
+    defer c.mutex.RUnlock()
+    return len(c.channels)
+}
 
-    ch := make(chan []byte)
-    id := c.addChannel(ch)
+func (c *Conn) Stats() tp.Stats {
+    c.deltaMutex.Lock()
+    defer c.deltaMutex.Unlock()
+    return c.stats.Copy()
+}
 
-    go func() {
-        c.request <- id
-        for json := range ch {
-            s.WriteMessage(websocket.TextMessage, json)
-        }
-    }()
+// requestSnapshot asks the fan-out loop to send a snapshot to client id,
+// first changing its subscription to sub if it is not nil.
+func (c *Conn) requestSnapshot(id int, sub *Subscription) {
+    c.sendRequest(request{id: id, sub: sub})
+}
 
-    if _, _, err := s.ReadMessage(); err != nil {
-        c.delChannel(id)
+func (c *Conn) sendRequest(r request) {
+    select {
+    case c.request <- r:
+    case <-c.closed:
     }
 }
 
@@ -102,63 +167,261 @@ func (c *Conn) EnvHandler(w http.ResponseWriter, r *http.Request) {
         Width: c.env.Width,
         Height: c.env.Height,
         ViableCellGeneration: config.ViableCellGeneration,
+        ColourModes: ColourModes,
     }
     json.NewEncoder(w).Encode(j)
 }
 
-func (c *Conn) Run() {
-    for {
-        select {
-        case dt, ok := <-c.deltas:
-            if !ok {
-                return
-            }
-            for _, cell := range dt.Cells {
-                c.cellMap.AddCell(cell)
-            }
-            c.stats.Add(dt.Stats)
-        case id := <-c.request:
-            ret := make(chan []byte)
-            go func() {
-                c.env.WithCells <- func(cs []*tp.Cell) {
-                    dt := &tp.Delta{
-                        Cells: cs,
-                        Stats: c.stats,
-                    }
-                    if js, err := json.Marshal(dt); err == nil {
-                        ret <- js
-                    } else {
-                        log.Println(err)
-                        close(ret)
-                    }
-                }
-            }()
-            js, ok := <-ret
-            if !ok {
-                break
-            }
-            close(ret)
-            c.mutex.RLock()
-            if ch, ok := c.channels[id]; ok {
-                ch <- js
-            }
-            c.mutex.RUnlock()
-        case <-c.update:
-            dt := &tp.Delta{
-                Cells: c.cellMap.Cells(),
-                Stats: c.stats,
+func parseTickRange(r *http.Request) (int64, int64, error) {
+    var from, to int64 = 0, -1
+    var err error
+
+    q := r.URL.Query()
+    if v := q.Get("from"); v != "" {
+        if from, err = strconv.ParseInt(v, 10, 64); err != nil {
+            return 0, 0, err
+        }
+    }
+    if v := q.Get("to"); v != "" {
+        if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+            return 0, 0, err
+        }
+    }
+
+    return from, to, nil
+}
+
+func (c *Conn) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+    from, to, err := parseTickRange(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if r.URL.Query().Get("format") == "csv" {
+        w.Header().Set("Content-Type", "text/csv")
+        if err := c.history.WriteCSV(w, from, to); err != nil {
+            log.Println(err)
+        }
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(c.history.Range(from, to))
+}
+
+func (c *Conn) GenotypesHandler(w http.ResponseWriter, r *http.Request) {
+    k := 10
+    if v := r.URL.Query().Get("k"); v != "" {
+        var err error
+        if k, err = strconv.Atoi(v); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    gs := c.tracker.Top(k)
+    js := make([]GenotypeJSON, len(gs))
+    for i, g := range gs {
+        js[i] = GenotypeJSON{
+            Genotype: g,
+            Disassembly: g.Genome.Disassemble(),
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(js)
+}
+
+func encodeDelta(dt *tp.Delta, binary bool) ([]byte, error) {
+    if binary {
+        return dt.MarshalBinary()
+    }
+    return json.Marshal(dt)
+}
+
+func (c *Conn) sendSnapshot(id int) {
+    c.mutex.RLock()
+    cl, ok := c.channels[id]
+    c.mutex.RUnlock()
+    if !ok {
+        return
+    }
+
+    var msg []byte
+    var err error
+
+    // Snapshots are made from the shadow only, so they never wait for the
+    // env and describe the state of a single broadcast.
+    switch {
+    case cl.binary:
+        msg, err = encodeDelta(&tp.Delta{
+            Cells: c.shadow.viewport(cl.sub, c.env.Width),
+            Stats: c.lastStats.Copy(),
+        }, true)
+    default:
+        msg, err = c.encodeSnapshot(cl.sub, cl.sub.Detail == DetailFull)
+    }
+
+    if err != nil {
+        log.Println(err)
+        return
+    }
+
+    c.mutex.RLock()
+    if cl, ok := c.channels[id]; ok && c.deliver(cl, msg) {
+        cl.resync = false
+    }
+    c.mutex.RUnlock()
+}
+
+func (c *Conn) broadcast() {
+    c.deltaMutex.Lock()
+    cells := c.cellMap.Cells()
+    c.cellMap.Reset()
+    stats := c.stats.Copy()
+    copy(c.execBuf, c.lastExec)
+    c.deltaMutex.Unlock()
+
+    c.seq++
+    cc := c.newColourContext(stats["Ticks"], c.execBuf)
+    diffs := c.shadow.update(cells, cc, c.seq % paletteRefresh == 0)
+    changed := diffStats(c.lastStats, stats)
+
+    msgs := make(map[string][]byte)
+    encode := func(cl *client) ([]byte, error) {
+        msg := DiffMsg{
+            Type: MsgDiff,
+            Seq: c.seq,
+            Cells: make([]CellDiff, 0),
+            Stats: changed,
+        }
+        switch {
+        case cl.binary:
+            return encodeDelta(&tp.Delta{
+                Cells: c.filterCells(cl.sub, cells),
+                Stats: stats,
+            }, true)
+        case cl.sub.Detail == DetailFull:
+            msg.Cells = withColour(c.filterDiffs(cl.sub, diffs), cl.sub.Colour)
+        case cl.sub.Detail == DetailColour:
+            msg.Cells = withoutGenomes(withColour(c.filterDiffs(cl.sub, diffs),
+                cl.sub.Colour))
+        case cl.sub.Detail == DetailTiles:
+            msg.Tiles = c.tiles(cl.sub, diffs)
+        }
+        return json.Marshal(msg)
+    }
+
+    resync := make([]int, 0)
+
+    c.mutex.RLock()
+    for id, cl := range c.channels {
+        if cl.resync {
+            // Wait for the queue to drain before sending a new snapshot.
+            if len(cl.ch) < cap(cl.ch) / 2 {
+                resync = append(resync, id)
             }
-            js, err := json.Marshal(dt)
-            if err != nil {
+            continue
+        }
+        k := fmt.Sprint(cl.binary, cl.sub.key())
+        msg, ok := msgs[k]
+        if !ok {
+            var err error
+            if msg, err = encode(cl); err != nil {
                 log.Println(err)
-                break
+                continue
             }
-            c.cellMap.Reset()
+            msgs[k] = msg
+        }
+        c.deliver(cl, msg)
+    }
+    c.mutex.RUnlock()
+
+    for _, id := range resync {
+        c.sendSnapshot(id)
+    }
+}
+
+// consume accumulates deltas until the channel is closed, independently of
+// the fan-out to clients so they cannot slow down the env.
+func (c *Conn) consume() {
+    defer close(c.done)
+
+    for dt := range c.deltas {
+        c.tracker.Apply(dt, c.env.GetConfig())
+        c.lineage.Apply(dt)
+
+        c.deltaMutex.Lock()
+        for _, cell := range dt.Cells {
+            c.cellMap.AddCell(cell)
+        }
+        if dt.Stats["Executions"] > 0 && dt.Neighborhood[0] != nil {
+            c.lastExec[dt.Neighborhood[0].Idx] = dt.Stats["Ticks"]
+        }
+        c.stats.Add(dt.Stats)
+        c.history.Add(c.stats)
+        c.deltaMutex.Unlock()
+    }
+}
+
+func (c *Conn) Run() {
+    // Deltas are consumed while the grid is loaded so the env does not block
+    // sending them; those already applied to the grid are no-ops.
+    go c.consume()
+
+    // The shadow is loaded while the env waits so that no delta consumed
+    // before it is loaded is overwritten by an older cell.
+    c.env.View(context.Background(), func(g tp.Grid) error {
+        cells := make([]*tp.Cell, g.Len())
+        for i := range cells {
+            cells[i] = g.Cell(int32(i)).Copy()
+        }
+        c.shadow.load(cells, c.newColourContext(0, nil))
+        return nil
+    })
+
+    // Once the deltas end, the last changes are broadcast and clients keep
+    // receiving snapshots of the final state until Close is called.
+    done, update := c.done, c.update
+    for {
+        select {
+        case <-done:
+            c.broadcast()
+            done, update = nil, nil
+        case <-c.closed:
+            return
+        case r := <-c.request:
             c.mutex.RLock()
-            for _, ch := range c.channels {
-                ch <- js
+            if cl, ok := c.channels[r.id]; ok {
+                if r.sub != nil {
+                    cl.sub = *r.sub
+                }
+                if r.colour != "" {
+                    cl.sub.Colour = r.colour
+                }
             }
             c.mutex.RUnlock()
+            c.sendSnapshot(r.id)
+        case <-update:
+            c.broadcast()
         }
     }
 }
+
+// Handler returns a handler serving the endpoints of c at their usual paths,
+// so that it can be mounted under a prefix.
+func (c *Conn) Handler() *http.ServeMux {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/ws", c.WebsocketHandler)
+    mux.HandleFunc("/sse", c.SSEHandler)
+    mux.HandleFunc("/poll", c.PollHandler)
+    mux.HandleFunc("/env", c.EnvHandler)
+    mux.HandleFunc("/history", c.HistoryHandler)
+    mux.HandleFunc("/genotypes", c.GenotypesHandler)
+    mux.HandleFunc("/cell", c.CellHandler)
+    mux.HandleFunc("/config", c.ConfigHandler)
+    mux.HandleFunc("/rng", c.RNGHandler)
+    mux.HandleFunc("/audit", c.AuditHandler)
+    return mux
+}
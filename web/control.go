@@ -0,0 +1,145 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    tp "tidepool/tidepool"
+)
+
+var errPermission = errors.New("permission denied")
+
+// Messages that change the env rather than what the client receives.
+var operatorMsgs = map[string]bool{
+    MsgPause: true,
+    MsgResume: true,
+    MsgStep: true,
+    MsgConfig: true,
+    MsgRNG: true,
+    MsgInject: true,
+}
+
+type ClockJSON struct {
+    Paused bool
+    Ticks int64
+}
+
+type InjectJSON struct {
+    ID int64
+}
+
+func (c *Conn) clock() ClockJSON {
+    return ClockJSON{
+        Paused: c.env.Paused(),
+        Ticks: c.env.GetMetrics().Ticks,
+    }
+}
+
+// handleMsg carries out msg from client id and returns the result of the
+// reply.
+func (c *Conn) handleMsg(id int, cl *client, remote string,
+    msg ClientMsg) (interface{}, error) {
+    if operatorMsgs[msg.Type] && cl.role < RoleOperator {
+        return nil, errPermission
+    }
+
+    switch msg.Type {
+    case MsgResync:
+        c.requestSnapshot(id, nil)
+    case MsgSubscribe:
+        if msg.Subscription == nil {
+            return nil, errors.New("missing subscription")
+        }
+        sub := *msg.Subscription
+        if err := sub.validate(c.env.Width, c.env.Height); err != nil {
+            return nil, err
+        }
+        c.requestSnapshot(id, &sub)
+    case MsgColour:
+        if !validColourMode(msg.Colour) {
+            return nil, fmt.Errorf("invalid colour mode: %s", msg.Colour)
+        }
+        c.sendRequest(request{id: id, colour: msg.Colour})
+    case MsgPause, MsgResume, MsgStep:
+        old := c.clock()
+        switch msg.Type {
+        case MsgPause:
+            c.env.Pause()
+        case MsgResume:
+            c.env.Resume()
+        case MsgStep:
+            n := msg.Steps
+            if n == 0 {
+                n = 1
+            }
+            if n < 0 {
+                return nil, fmt.Errorf("invalid steps: %d", n)
+            }
+            c.env.Step(n)
+        }
+        clock := c.clock()
+        c.audit.add(AuditEntry{time.Now(), remote, msg.Type, old, clock})
+        return clock, nil
+    case MsgConfig:
+        return c.updateConfig(remote, func(config *tp.Config) error {
+            return decodeUpdate(bytes.NewReader(msg.Config), config)
+        })
+    case MsgRNG:
+        return c.updateRNG(remote, func(rng *tp.DefaultRNG) error {
+            return decodeUpdate(bytes.NewReader(msg.RNG), rng)
+        })
+    case MsgInject:
+        m := msg.Inject
+        if m == nil {
+            return nil, errors.New("missing cell")
+        }
+        cellID, err := c.env.Inject(m.X, m.Y, m.Genome, m.Energy, m.Generation)
+        if err != nil {
+            return nil, err
+        }
+        c.audit.add(AuditEntry{time.Now(), remote, "inject", nil, m})
+        return InjectJSON{cellID}, nil
+    default:
+        return nil, fmt.Errorf("invalid message type: %s", msg.Type)
+    }
+
+    return nil, nil
+}
+
+func newReply(msgID int64, result interface{}, err error) ReplyMsg {
+    r := ReplyMsg{
+        Type: MsgReply,
+        ID: msgID,
+    }
+    if err != nil {
+        r.Error = err.Error()
+    } else {
+        r.Result = result
+    }
+    return r
+}
+
+// reply queues the answer to message msgID for client id. Replies are
+// dropped if the queue of the client is full.
+func (c *Conn) reply(id int, msgID int64, result interface{}, err error) {
+    b, err := json.Marshal(newReply(msgID, result, err))
+    if err != nil {
+        log.Println(err)
+        return
+    }
+
+    c.mutex.RLock()
+    defer c.mutex.RUnlock()
+    if cl, ok := c.channels[id]; ok {
+        select {
+        case cl.ch <- b:
+        default:
+        }
+    }
+}
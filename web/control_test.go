@@ -0,0 +1,63 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    tp "tidepool/tidepool"
+)
+
+func TestHandleMsg(t *testing.T) {
+    env, err := tp.NewEnv(8, 8, 16, 0, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := NewConn(env, nil, nil, tp.NewHistory(10, 4, 1, 2), DefaultOptions)
+
+    viewer := &client{role: RoleViewer}
+    _, err = c.handleMsg(0, viewer, "test", ClientMsg{Type: MsgPause})
+    if err != errPermission {
+        t.Fatalf("expected permission error, got %v", err)
+    }
+
+    operator := &client{role: RoleOperator}
+    res, err := c.handleMsg(0, operator, "test", ClientMsg{Type: MsgPause})
+    if err != nil || !res.(ClockJSON).Paused || !env.Paused() {
+        t.Fatalf("expected paused env, got %v, %v", res, err)
+    }
+
+    res, err = c.handleMsg(0, operator, "test", ClientMsg{
+        Type: MsgConfig,
+        Config: json.RawMessage(`{"InflowFrequency": 20}`),
+    })
+    if err != nil || res.(tp.Config).InflowFrequency != 20 ||
+        env.GetConfig().FailedKillPenalty != tp.DefaultConfig().FailedKillPenalty {
+        t.Fatalf("unexpected config update: %v, %v", res, err)
+    }
+
+    if _, err := c.handleMsg(0, operator, "test", ClientMsg{
+        Type: MsgConfig,
+        Config: json.RawMessage(`{"InflowFrequency": 0}`),
+    }); err == nil || env.GetConfig().InflowFrequency != 20 {
+        t.Fatalf("expected invalid config to be rejected, got %v", err)
+    }
+
+    _, err = c.handleMsg(0, operator, "test", ClientMsg{Type: "bogus"})
+    if err == nil {
+        t.Fatal("expected error for invalid message type")
+    }
+    if len(c.audit.list()) != 2 {
+        t.Fatalf("expected 2 audit entries, got %v", c.audit.list())
+    }
+
+    // The audit log is for operators only.
+    w := httptest.NewRecorder()
+    c.AuditHandler(w, httptest.NewRequest("GET", "/audit", nil))
+    if w.Code != http.StatusForbidden {
+        t.Errorf("expected viewer to be refused the audit log, got %d", w.Code)
+    }
+}
@@ -0,0 +1,303 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// For networks that drop websocket upgrades, the messages sent to websocket
+// clients are also served as Server-Sent Events and by long polling. These
+// clients go through the same fan-out as websocket clients: they have a
+// queue of QueueSize messages and are subject to the slow client policy.
+// Only JSON messages are served. Poll clients send client messages by POST to
+// their session; SSE clients are receive-only, since they have no session,
+// and reconnect to resync or to change their subscription.
+
+var (
+    errSessionGone = errors.New("session closed")
+    errBinary = errors.New("binary format requires a websocket")
+)
+
+// newHTTPClient returns a client without a socket for r, or writes an error
+// and returns nil.
+func (c *Conn) newHTTPClient(w http.ResponseWriter, r *http.Request) *client {
+    role, err := c.options.role(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return nil
+    }
+
+    q := r.URL.Query()
+    if q.Get("format") == "binary" {
+        http.Error(w, errBinary.Error(), http.StatusBadRequest)
+        return nil
+    }
+    sub, err := parseSubscription(q, c.env.Width, c.env.Height)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return nil
+    }
+
+    return &client{
+        ch: make(chan []byte, c.options.QueueSize),
+        quit: make(chan struct{}),
+        role: role,
+        sub: sub,
+    }
+}
+
+// SSEHandler streams messages as Server-Sent Events with the message as data.
+// The stream starts with a snapshot for the subscription in the query. SSE
+// clients cannot send client messages: one that misses a message reconnects
+// to receive a new snapshot, and uses long polling to control the env.
+func (c *Conn) SSEHandler(w http.ResponseWriter, r *http.Request) {
+    f, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+    cl := c.newHTTPClient(w, r)
+    if cl == nil {
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    // Keeps proxies such as nginx from buffering the stream.
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+    f.Flush()
+
+    id := c.addChannel(cl)
+    defer c.delChannel(id)
+    c.requestSnapshot(id, nil)
+
+    ping := time.NewTicker(c.options.PongTimeout * 9 / 10)
+    defer ping.Stop()
+
+    for {
+        var err error
+        select {
+        case msg, ok := <-cl.ch:
+            if !ok {
+                return
+            }
+            _, err = fmt.Fprintf(w, "data: %s\n\n", msg)
+        case <-ping.C:
+            _, err = fmt.Fprint(w, ": ping\n\n")
+        case <-cl.quit:
+            return
+        case <-r.Context().Done():
+            return
+        }
+        if err != nil {
+            return
+        }
+        f.Flush()
+    }
+}
+
+type pollMsg struct {
+    seq int64
+    msg json.RawMessage
+    sent bool
+}
+
+// A pollSession holds the messages of a polling client until it acknowledges
+// them. At most QueueSize messages are held, so that a client that does not
+// poll fills its queue like a slow websocket client.
+type pollSession struct {
+    id int
+    cl *client
+    mutex sync.Mutex
+    pending []pollMsg
+    expiry *time.Timer
+}
+
+type PollJSON struct {
+    Session string
+    Messages []json.RawMessage
+}
+
+// take acknowledges the sent messages with a sequence number up to since and
+// returns the pending messages, waiting up to wait for one if there are none.
+// Clients that have not received a message yet pass a negative since.
+func (s *pollSession) take(since int64, max int, wait time.Duration,
+    cancel <-chan struct{}) ([]json.RawMessage, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    pending := s.pending[:0]
+    for _, m := range s.pending {
+        if !m.sent || m.seq > since {
+            pending = append(pending, m)
+        }
+    }
+    s.pending = pending
+
+    add := func(msg []byte) {
+        var h struct{ Seq int64 }
+        json.Unmarshal(msg, &h)
+        s.pending = append(s.pending, pollMsg{seq: h.Seq, msg: msg})
+    }
+
+    if len(s.pending) == 0 {
+        t := time.NewTimer(wait)
+        defer t.Stop()
+        select {
+        case msg, ok := <-s.cl.ch:
+            if !ok {
+                return nil, errSessionGone
+            }
+            add(msg)
+        case <-s.cl.quit:
+            return nil, errSessionGone
+        case <-t.C:
+        case <-cancel:
+        }
+    }
+
+fill:
+    for len(s.pending) < max {
+        select {
+        case msg, ok := <-s.cl.ch:
+            if !ok {
+                return nil, errSessionGone
+            }
+            add(msg)
+        default:
+            break fill
+        }
+    }
+
+    msgs := make([]json.RawMessage, len(s.pending))
+    for i := range s.pending {
+        s.pending[i].sent = true
+        msgs[i] = s.pending[i].msg
+    }
+    return msgs, nil
+}
+
+func newSessionName() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// newPollSession registers a client for r whose session ends if it is not
+// polled within PongTimeout.
+func (c *Conn) newPollSession(w http.ResponseWriter,
+    r *http.Request) (string, *pollSession) {
+    cl := c.newHTTPClient(w, r)
+    if cl == nil {
+        return "", nil
+    }
+    name, err := newSessionName()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return "", nil
+    }
+
+    s := &pollSession{id: c.addChannel(cl), cl: cl}
+    s.expiry = time.AfterFunc(c.options.PongTimeout, func() {
+        c.endPollSession(name)
+    })
+    c.sessionMutex.Lock()
+    c.sessions[name] = s
+    c.sessionMutex.Unlock()
+
+    c.requestSnapshot(s.id, nil)
+    return name, s
+}
+
+func (c *Conn) endPollSession(name string) {
+    c.sessionMutex.Lock()
+    s, ok := c.sessions[name]
+    delete(c.sessions, name)
+    c.sessionMutex.Unlock()
+
+    if ok {
+        s.expiry.Stop()
+        c.delChannel(s.id)
+        s.cl.disconnect()
+    }
+}
+
+// PollHandler serves long polls. A GET without a session query parameter
+// starts a session; the response holds its name and a snapshot. Later GETs
+// pass the session and the sequence number of the last message applied as
+// since, and receive the messages after it, waiting up to PollTimeout for
+// one. A POST to a session carries a client message and is answered with its
+// reply.
+func (c *Conn) PollHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    name := q.Get("session")
+
+    var s *pollSession
+    if name == "" {
+        if r.Method != http.MethodGet {
+            http.Error(w, "missing session", http.StatusBadRequest)
+            return
+        }
+        if name, s = c.newPollSession(w, r); s == nil {
+            return
+        }
+    } else {
+        c.sessionMutex.Lock()
+        s = c.sessions[name]
+        c.sessionMutex.Unlock()
+        if s == nil {
+            http.Error(w, errSessionGone.Error(), http.StatusGone)
+            return
+        }
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        since := int64(-1)
+        if v := q.Get("since"); v != "" {
+            var err error
+            if since, err = strconv.ParseInt(v, 10, 64); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+        }
+
+        // Sessions do not expire while they are being polled.
+        s.expiry.Stop()
+        msgs, err := s.take(since, c.options.QueueSize, c.options.PollTimeout,
+            r.Context().Done())
+        if err != nil {
+            c.endPollSession(name)
+            http.Error(w, err.Error(), http.StatusGone)
+            return
+        }
+        s.expiry.Reset(c.options.PongTimeout)
+
+        w.Header().Set("Cache-Control", "no-cache")
+        writeJSON(w, PollJSON{Session: name, Messages: msgs})
+    case http.MethodPost:
+        var msg ClientMsg
+        var result interface{}
+        err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1 << 20)).
+            Decode(&msg)
+        if err == nil {
+            result, err = c.handleMsg(s.id, s.cl, r.RemoteAddr, msg)
+        }
+        writeJSON(w, newReply(msg.ID, result, err))
+    default:
+        w.Header().Set("Allow", "GET, POST")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
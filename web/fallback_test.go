@@ -0,0 +1,36 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestPollSessionTake(t *testing.T) {
+    cl := &client{ch: make(chan []byte, 4), quit: make(chan struct{})}
+    s := &pollSession{cl: cl}
+    for seq := 1; seq <= 3; seq++ {
+        cl.ch <- []byte(fmt.Sprintf(`{"Seq": %d}`, seq))
+    }
+
+    msgs, err := s.take(-1, 2, 0, nil)
+    if err != nil || len(msgs) != 2 {
+        t.Fatalf("expected 2 messages, got %d, %v", len(msgs), err)
+    }
+    // Unacknowledged messages are sent again.
+    msgs, err = s.take(1, 2, 0, nil)
+    if err != nil || len(msgs) != 2 || string(msgs[0]) != `{"Seq": 2}` {
+        t.Fatalf("expected messages 2 and 3, got %s, %v", msgs, err)
+    }
+    msgs, err = s.take(3, 2, time.Millisecond, nil)
+    if err != nil || len(msgs) != 0 {
+        t.Fatalf("expected no messages, got %s, %v", msgs, err)
+    }
+
+    cl.disconnect()
+    if _, err := s.take(3, 2, time.Second, nil); err != errSessionGone {
+        t.Fatalf("expected closed session, got %v", err)
+    }
+}
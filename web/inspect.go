@@ -0,0 +1,101 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strconv"
+
+    tp "tidepool/tidepool"
+)
+
+const maxAncestors = 64
+
+type CellInfo struct {
+    Cell *tp.Cell
+    Viable bool
+    Disassembly []string
+    // The 8 neighbors of the cell.
+    Neighborhood []*tp.Cell
+    Ancestors []tp.Ancestor
+    Genotype *tp.Genotype `json:",omitempty"`
+}
+
+// inspect returns the cell at idx, or with the given ID if idx is negative,
+// and its neighbors. IDs are resolved with the shadow so that the env only
+// waits for the neighborhood to be copied; a cell that has died since the
+// last broadcast is not found.
+func (c *Conn) inspect(idx int32, id int64) (*tp.Cell, []*tp.Cell) {
+    var cell *tp.Cell
+    var nh []*tp.Cell
+
+    if idx < 0 {
+        var ok bool
+        if idx, ok = c.shadow.lookup(id); !ok {
+            return nil, nil
+        }
+    }
+
+    c.env.View(context.Background(), func(g tp.Grid) error {
+        if id != 0 && g.Cell(idx).ID() != id {
+            return nil
+        }
+        for i, v := range g.Neighborhood(idx) {
+            if i == 0 {
+                cell = v.Copy()
+            } else {
+                nh = append(nh, v.Copy())
+            }
+        }
+        return nil
+    })
+
+    return cell, nh
+}
+
+func (c *Conn) CellHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+
+    idx := int32(-1)
+    var id int64
+
+    if v := q.Get("id"); v != "" {
+        var err error
+        if id, err = strconv.ParseInt(v, 10, 64); err != nil || id == 0 {
+            http.Error(w, "invalid id", http.StatusBadRequest)
+            return
+        }
+    } else {
+        x, errX := strconv.ParseInt(q.Get("x"), 10, 32)
+        y, errY := strconv.ParseInt(q.Get("y"), 10, 32)
+        if errX != nil || errY != nil || x < 0 || y < 0 ||
+            int32(x) >= c.env.Width || int32(y) >= c.env.Height {
+            http.Error(w, "invalid coordinates", http.StatusBadRequest)
+            return
+        }
+        idx = int32(y) * c.env.Width + int32(x)
+    }
+
+    cell, nh := c.inspect(idx, id)
+    if cell == nil {
+        http.Error(w, "cell not found", http.StatusNotFound)
+        return
+    }
+
+    config := c.env.GetConfig()
+    info := CellInfo{
+        Cell: cell,
+        Viable: cell.Energy > 0 && cell.Generation >= config.ViableCellGeneration,
+        Disassembly: cell.Genome.Disassemble(),
+        Neighborhood: nh,
+        Ancestors: c.lineage.Ancestors(cell.ID, maxAncestors),
+    }
+    if g, ok := c.tracker.Get(cell.Genome.Hash()); ok {
+        info.Genotype = &g
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,380 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "encoding/json"
+    "sync"
+
+    tp "tidepool/tidepool"
+    "tidepool/tidepool/gene"
+)
+
+// Clients first receive a snapshot message holding every cell that differs
+// from a blank cell, then a diff message per update holding only the fields
+// that changed. Messages are numbered: a diff with sequence number n applies
+// to the state of message n - 1. A client that misses a message sends a
+// resync message and receives a new snapshot. A subscribe message changes
+// the viewport and level of detail of the client and is answered with a
+// snapshot.
+//
+// Every client message is answered with a reply message carrying the ID of
+// the message and either an error or a result. Messages that control the env
+// require the operator role.
+const (
+    MsgSnapshot = "snapshot"
+    MsgDiff = "diff"
+    MsgReply = "reply"
+
+    MsgResync = "resync"
+    MsgSubscribe = "subscribe"
+    // Changes the colour mode of the client; answered with a snapshot.
+    MsgColour = "colour"
+
+    MsgPause = "pause"
+    MsgResume = "resume"
+    // Advances a paused env by Steps ticks, or 1 if Steps is 0.
+    MsgStep = "step"
+    // Updates the fields of the config in Config.
+    MsgConfig = "config"
+    // Updates the fields of the default RNG in RNG.
+    MsgRNG = "rng"
+    // Places the cell in Inject.
+    MsgInject = "inject"
+)
+
+type cellState struct {
+    ID int64
+    Origin int64
+    Parent int64
+    Generation int64
+    Energy int64
+    Key uint32
+    Palette [len(paletteModes)]uint8
+
+    // Origin palette index, cached as it hashes Origin.
+    originColour uint8
+    // Shared with the cell it was made from, which is not changed.
+    genome gene.Genome
+}
+
+// CellDiff holds the changed fields of a cell. Key is a colour key derived
+// from the genome hash, so clients need not receive genomes to tell
+// genotypes apart.
+type CellDiff struct {
+    Idx int32
+    ID *int64 `json:",omitempty"`
+    Origin *int64 `json:",omitempty"`
+    Parent *int64 `json:",omitempty"`
+    Generation *int64 `json:",omitempty"`
+    Energy *int64 `json:",omitempty"`
+    Key *uint32 `json:",omitempty"`
+    // Palette index in the colour mode of the client.
+    Colour *uint8 `json:",omitempty"`
+    Genome gene.Genome `json:",omitempty"`
+
+    fieldsChanged bool
+    palette [len(paletteModes)]uint8
+    // Bit i is set if the palette index of paletteModes[i] changed.
+    paletteChanged uint8
+}
+
+type SnapshotMsg struct {
+    Type string
+    Seq int64
+    Width int32
+    Height int32
+    BlankKey uint32
+    Subscription Subscription
+    Cells []CellDiff
+    Tiles []TileSummary `json:",omitempty"`
+    Stats tp.Stats
+}
+
+type DiffMsg struct {
+    Type string
+    Seq int64
+    Cells []CellDiff
+    Tiles []TileSummary `json:",omitempty"`
+    Stats tp.Stats
+}
+
+type ClientMsg struct {
+    Type string
+    ID int64 `json:",omitempty"`
+    Subscription *Subscription `json:",omitempty"`
+    Colour string `json:",omitempty"`
+    Steps int64 `json:",omitempty"`
+    Config json.RawMessage `json:",omitempty"`
+    RNG json.RawMessage `json:",omitempty"`
+    Inject *InjectMsg `json:",omitempty"`
+}
+
+type InjectMsg struct {
+    X int32
+    Y int32
+    Genome gene.Genome
+    Energy int64
+    Generation int64
+}
+
+type ReplyMsg struct {
+    Type string
+    ID int64 `json:",omitempty"`
+    Error string `json:",omitempty"`
+    Result interface{} `json:",omitempty"`
+}
+
+func colourKey(g gene.Genome) uint32 {
+    return uint32(g.Hash()) & 0xffffff
+}
+
+func newCellState(c *tp.Cell) cellState {
+    return cellState{
+        ID: c.ID,
+        Origin: c.Origin,
+        Parent: c.Parent,
+        Generation: c.Generation,
+        Energy: c.Energy,
+        Key: colourKey(c.Genome),
+        originColour: originColour(c.Origin),
+        genome: c.Genome,
+    }
+}
+
+// cell returns the cell at idx described by s.
+func (s cellState) cell(idx, width int32) *tp.Cell {
+    return &tp.Cell{
+        Idx: idx,
+        X: idx % width,
+        Y: idx / width,
+        ID: s.ID,
+        Origin: s.Origin,
+        Parent: s.Parent,
+        Generation: s.Generation,
+        Energy: s.Energy,
+        Genome: s.genome,
+    }
+}
+
+// diffCellState returns the fields of n that differ from o.
+func diffCellState(idx int32, o, n cellState) (CellDiff, bool) {
+    d := CellDiff{Idx: idx, palette: n.Palette}
+    changed := false
+
+    field := func(ov, nv int64) *int64 {
+        if ov == nv {
+            return nil
+        }
+        changed = true
+        return &nv
+    }
+    d.ID = field(o.ID, n.ID)
+    d.Origin = field(o.Origin, n.Origin)
+    d.Parent = field(o.Parent, n.Parent)
+    d.Generation = field(o.Generation, n.Generation)
+    d.Energy = field(o.Energy, n.Energy)
+    if o.Key != n.Key {
+        key := n.Key
+        d.Key = &key
+        changed = true
+    }
+    d.fieldsChanged = changed
+
+    for i := range n.Palette {
+        if o.Palette[i] != n.Palette[i] {
+            d.paletteChanged |= 1 << uint(i)
+            changed = true
+        }
+    }
+
+    return d, changed
+}
+
+// withoutGenomes returns a copy of cs with genomes omitted.
+func withoutGenomes(cs []CellDiff) []CellDiff {
+    n := make([]CellDiff, len(cs))
+    for i, c := range cs {
+        c.Genome = nil
+        n[i] = c
+    }
+    return n
+}
+
+// diffStats returns the stats in s that differ from last and updates last.
+func diffStats(last, s tp.Stats) tp.Stats {
+    d := make(tp.Stats)
+    for n, v := range s {
+        if o, ok := last[n]; !ok || o != v {
+            d[n] = v
+            last[n] = v
+        }
+    }
+    return d
+}
+
+// shadow is the cell state last sent to clients.
+type shadow struct {
+    blank cellState
+    cells []cellState
+    // Index of the cell with each ID, the only part of the shadow that may
+    // be read outside the fan-out loop.
+    idMutex *sync.RWMutex
+    ids map[int64]int32
+}
+
+func newShadow(e *tp.Env) *shadow {
+    g := make(gene.Genome, e.GenomeSize)
+    for i := range g {
+        g[i] = gene.STOP
+    }
+    blank := cellState{
+        Key: colourKey(g),
+        genome: g,
+    }
+    sh := &shadow{
+        blank: blank,
+        cells: make([]cellState, e.Width * e.Height),
+        idMutex: &sync.RWMutex{},
+        ids: make(map[int64]int32),
+    }
+    for i := range sh.cells {
+        sh.cells[i] = blank
+    }
+    return sh
+}
+
+// update records the state of cs and returns the differences of the cells
+// from their previous state, including genomes of cells whose key changed.
+// Palette indices of the other cells, some of which depend on time and on
+// genotype ranks, are only recomputed if refresh is set.
+func (sh *shadow) update(cs []*tp.Cell, cc *colourContext,
+    refresh bool) []CellDiff {
+    sh.idMutex.Lock()
+    defer sh.idMutex.Unlock()
+
+    ds := make([]CellDiff, 0, len(cs))
+    add := func(idx int32, n cellState, g gene.Genome) {
+        o := sh.cells[idx]
+        n.Palette = cc.palette(idx, n)
+        d, diff := diffCellState(idx, o, n)
+        if !diff {
+            return
+        }
+        if d.Key != nil {
+            d.Genome = g
+        }
+        sh.set(idx, n)
+        ds = append(ds, d)
+    }
+
+    if !refresh {
+        for _, c := range cs {
+            add(c.Idx, newCellState(c), c.Genome)
+        }
+        return ds
+    }
+
+    changed := make(map[int32]*tp.Cell, len(cs))
+    for _, c := range cs {
+        changed[c.Idx] = c
+    }
+    for i, o := range sh.cells {
+        if c, ok := changed[int32(i)]; ok {
+            add(c.Idx, newCellState(c), c.Genome)
+        } else if o.Energy != 0 {
+            // Palettes of cells that are not live do not change.
+            add(int32(i), o, nil)
+        }
+    }
+    return ds
+}
+
+func (sh *shadow) load(cs []*tp.Cell, cc *colourContext) {
+    sh.idMutex.Lock()
+    defer sh.idMutex.Unlock()
+
+    for _, c := range cs {
+        s := newCellState(c)
+        s.Palette = cc.palette(c.Idx, s)
+        sh.set(c.Idx, s)
+    }
+}
+
+// set replaces the state of the cell at idx, keeping ids up to date. The
+// caller holds idMutex.
+func (sh *shadow) set(idx int32, s cellState) {
+    if o := sh.cells[idx]; o.ID != s.ID {
+        if i, ok := sh.ids[o.ID]; ok && i == idx {
+            delete(sh.ids, o.ID)
+        }
+        if s.ID != 0 {
+            sh.ids[s.ID] = idx
+        }
+    }
+    sh.cells[idx] = s
+}
+
+// lookup returns the index of the cell with the given ID as of the last
+// broadcast. It is safe to call outside the fan-out loop.
+func (sh *shadow) lookup(id int64) (int32, bool) {
+    sh.idMutex.RLock()
+    defer sh.idMutex.RUnlock()
+    idx, ok := sh.ids[id]
+    return idx, ok
+}
+
+// viewport returns the cells in the viewport of sub.
+func (sh *shadow) viewport(sub Subscription, width int32) []*tp.Cell {
+    cs := make([]*tp.Cell, 0)
+    for i, s := range sh.cells {
+        idx := int32(i)
+        if sub.contains(idx % width, idx / width) {
+            cs = append(cs, s.cell(idx, width))
+        }
+    }
+    return cs
+}
+
+// snapshot returns every cell in the viewport of sub that differs from a
+// blank cell, with its genome if genomes is set.
+func (sh *shadow) snapshot(sub Subscription, width int32,
+    genomes bool) []CellDiff {
+    ds := make([]CellDiff, 0)
+    for i, s := range sh.cells {
+        if !sub.contains(int32(i) % width, int32(i) / width) {
+            continue
+        }
+        d, changed := diffCellState(int32(i), sh.blank, s)
+        if !changed {
+            continue
+        }
+        if genomes {
+            d.Genome = s.genome
+        }
+        ds = append(ds, d)
+    }
+    return ds
+}
+
+// encodeSnapshot encodes a snapshot of the shadow, which is the state sent to
+// clients at the sequence number of the snapshot.
+func (c *Conn) encodeSnapshot(sub Subscription, genomes bool) ([]byte, error) {
+    msg := SnapshotMsg{
+        Type: MsgSnapshot,
+        Seq: c.seq,
+        Width: c.env.Width,
+        Height: c.env.Height,
+        BlankKey: c.shadow.blank.Key,
+        Subscription: sub,
+        Cells: make([]CellDiff, 0),
+        Stats: c.lastStats.Copy(),
+    }
+    if sub.Detail == DetailTiles {
+        msg.Tiles = c.tiles(sub, nil)
+    } else {
+        msg.Cells = withColour(c.shadow.snapshot(sub, c.env.Width, genomes),
+            sub.Colour)
+    }
+    return json.Marshal(msg)
+}
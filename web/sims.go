@@ -0,0 +1,338 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    tp "tidepool/tidepool"
+)
+
+// Simulations are served under /sim/{name}/ with the endpoints of their Conn
+// and managed through the API under /api/sims:
+//
+//     GET /api/sims                list simulations
+//     POST /api/sims               create a simulation from a SimRequest
+//     GET /api/sims/{name}         describe a simulation
+//     POST /api/sims/{name}/stop   stop the env of a simulation
+//     DELETE /api/sims/{name}      stop and remove a simulation
+//
+// Changes require the operator role. A stopped simulation keeps serving the
+// state it reached until it is deleted.
+const (
+    SimPrefix = "/sim/"
+    SimsAPIPrefix = "/api/sims"
+)
+
+var (
+    errSimExists = errors.New("simulation exists")
+    errNoSim = errors.New("no such simulation")
+    errTooManySims = errors.New("too many simulations")
+    simName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// SimParams holds the env of a simulation and what is needed to serve it.
+type SimParams struct {
+    Env *tp.Env
+    Deltas <-chan *tp.Delta
+    History *tp.History
+    // Reported by the API, e.g. the experiment the env was created from.
+    Spec interface{}
+}
+
+// A SimFactory creates and starts the env described by spec.
+type SimFactory func(spec json.RawMessage) (SimParams, error)
+
+type Sim struct {
+    Name string
+    Created time.Time
+    Env *tp.Env
+    Conn *Conn
+    Spec interface{}
+
+    handler http.Handler
+    ticker *time.Ticker
+    // Guarded by the mutex of Sims.
+    stopped bool
+}
+
+type SimJSON struct {
+    Name string
+    Created time.Time
+    Running bool
+    Ticks int64
+    Clients int
+    Spec interface{} `json:",omitempty"`
+}
+
+type SimRequest struct {
+    Name string
+    Spec json.RawMessage
+}
+
+// Sims holds named simulations, each with its own env and Conn.
+type Sims struct {
+    factory SimFactory
+    update time.Duration
+    options Options
+    // Maximum number of simulations; 0 is unlimited.
+    max int
+    // Called with the mux of each new simulation to add further routes.
+    routes func(*Sim, *http.ServeMux)
+
+    mutex *sync.RWMutex
+    sims map[string]*Sim
+}
+
+func NewSims(f SimFactory, update time.Duration, max int, o Options,
+    routes func(*Sim, *http.ServeMux)) *Sims {
+    return &Sims{
+        factory: f,
+        update: update,
+        options: o,
+        max: max,
+        routes: routes,
+        mutex: &sync.RWMutex{},
+        sims: make(map[string]*Sim),
+    }
+}
+
+// Add serves the simulation made of p as name.
+func (s *Sims) Add(name string, p SimParams) (*Sim, error) {
+    if !simName.MatchString(name) {
+        return nil, fmt.Errorf("invalid simulation name: %q", name)
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if _, ok := s.sims[name]; ok {
+        return nil, errSimExists
+    }
+    if s.max > 0 && len(s.sims) >= s.max {
+        return nil, errTooManySims
+    }
+
+    ticker := time.NewTicker(s.update)
+    conn := NewConn(p.Env, p.Deltas, ticker.C, p.History, s.options)
+    sim := &Sim{
+        Name: name,
+        Created: time.Now(),
+        Env: p.Env,
+        Conn: conn,
+        Spec: p.Spec,
+        ticker: ticker,
+    }
+    mux := conn.Handler()
+    if s.routes != nil {
+        s.routes(sim, mux)
+    }
+    sim.handler = http.StripPrefix(SimPrefix + name, mux)
+    s.sims[name] = sim
+
+    go conn.Run()
+    return sim, nil
+}
+
+// Create starts a simulation from spec and serves it as name.
+func (s *Sims) Create(name string, spec json.RawMessage) (*Sim, error) {
+    if !simName.MatchString(name) {
+        return nil, fmt.Errorf("invalid simulation name: %q", name)
+    }
+    if s.Get(name) != nil {
+        return nil, errSimExists
+    }
+
+    p, err := s.factory(spec)
+    if err != nil {
+        return nil, err
+    }
+    sim, err := s.Add(name, p)
+    if err != nil {
+        p.Env.Stop()
+    }
+    return sim, err
+}
+
+func (s *Sims) Get(name string) *Sim {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return s.sims[name]
+}
+
+func (s *Sims) List() []SimJSON {
+    s.mutex.RLock()
+    js := make([]SimJSON, 0, len(s.sims))
+    for _, sim := range s.sims {
+        js = append(js, sim.json(false))
+    }
+    s.mutex.RUnlock()
+
+    sort.Slice(js, func(i, j int) bool { return js[i].Name < js[j].Name })
+    return js
+}
+
+// Describe returns the description of the simulation name.
+func (s *Sims) Describe(name string) (SimJSON, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    sim, ok := s.sims[name]
+    if !ok {
+        return SimJSON{}, errNoSim
+    }
+    return sim.json(true), nil
+}
+
+func (sim *Sim) json(spec bool) SimJSON {
+    j := SimJSON{
+        Name: sim.Name,
+        Created: sim.Created,
+        Running: !sim.stopped,
+        Ticks: sim.Env.GetMetrics().Ticks,
+        Clients: sim.Conn.Clients(),
+    }
+    if spec {
+        j.Spec = sim.Spec
+    }
+    return j
+}
+
+// Stop stops the env of the simulation name.
+func (s *Sims) Stop(name string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    sim, ok := s.sims[name]
+    if !ok {
+        return errNoSim
+    }
+    if !sim.stopped {
+        sim.stopped = true
+        sim.Env.Stop()
+    }
+    return nil
+}
+
+// Delete stops the simulation name and disconnects its clients.
+func (s *Sims) Delete(name string) error {
+    s.mutex.Lock()
+    sim, ok := s.sims[name]
+    delete(s.sims, name)
+    s.mutex.Unlock()
+    if !ok {
+        return errNoSim
+    }
+
+    sim.Env.Stop()
+    sim.ticker.Stop()
+    sim.Conn.Close()
+    return nil
+}
+
+// Close deletes every simulation.
+func (s *Sims) Close() {
+    for _, j := range s.List() {
+        s.Delete(j.Name)
+    }
+}
+
+// SimHandler serves the endpoints of simulations under SimPrefix.
+func (s *Sims) SimHandler(w http.ResponseWriter, r *http.Request) {
+    path := strings.TrimPrefix(r.URL.Path, SimPrefix)
+    name := path
+    if i := strings.Index(path, "/"); i >= 0 {
+        name = path[:i]
+    } else {
+        // Relative URLs of the index page resolve against the directory.
+        http.Redirect(w, r, SimPrefix + name + "/", http.StatusMovedPermanently)
+        return
+    }
+
+    sim := s.Get(name)
+    if sim == nil {
+        http.Error(w, errNoSim.Error(), http.StatusNotFound)
+        return
+    }
+    sim.handler.ServeHTTP(w, r)
+}
+
+func writeSimError(w http.ResponseWriter, err error) {
+    switch err {
+    case errNoSim:
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errSimExists, errTooManySims:
+        http.Error(w, err.Error(), http.StatusConflict)
+    default:
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    }
+}
+
+// APIHandler serves the API under SimsAPIPrefix.
+func (s *Sims) APIHandler(w http.ResponseWriter, r *http.Request) {
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, SimsAPIPrefix), "/")
+    parts := strings.Split(path, "/")
+
+    if r.Method != http.MethodGet &&
+        !s.options.authorize(w, r, RoleOperator) {
+        return
+    }
+
+    switch {
+    case path == "" && r.Method == http.MethodGet:
+        writeJSON(w, s.List())
+    case path == "" && r.Method == http.MethodPost:
+        var req SimRequest
+        d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1 << 20))
+        d.DisallowUnknownFields()
+        if err := d.Decode(&req); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        sim, err := s.Create(req.Name, req.Spec)
+        if err != nil {
+            writeSimError(w, err)
+            return
+        }
+        j, err := s.Describe(sim.Name)
+        if err != nil {
+            writeSimError(w, err)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Location", SimPrefix + sim.Name + "/")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(j)
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        j, err := s.Describe(parts[0])
+        if err != nil {
+            writeSimError(w, err)
+            return
+        }
+        writeJSON(w, j)
+    case len(parts) == 1 && r.Method == http.MethodDelete:
+        if err := s.Delete(parts[0]); err != nil {
+            writeSimError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    case len(parts) == 2 && parts[1] == "stop" && r.Method == http.MethodPost:
+        if err := s.Stop(parts[0]); err != nil {
+            writeSimError(w, err)
+            return
+        }
+        j, err := s.Describe(parts[0])
+        if err != nil {
+            writeSimError(w, err)
+            return
+        }
+        writeJSON(w, j)
+    default:
+        http.Error(w, "not found", http.StatusNotFound)
+    }
+}
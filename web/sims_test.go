@@ -0,0 +1,147 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    tp "tidepool/tidepool"
+)
+
+func TestSimsAPI(t *testing.T) {
+    factory := func(spec json.RawMessage) (SimParams, error) {
+        env, err := tp.NewEnv(8, 8, 16, 0, 1)
+        if err != nil {
+            return SimParams{}, err
+        }
+        return SimParams{
+            Env: env,
+            Deltas: make(chan *tp.Delta),
+            History: tp.NewHistory(10, 4, 1, 2),
+            Spec: spec,
+        }, nil
+    }
+    opts := DefaultOptions
+    opts.Role = RoleOperator
+    sims := NewSims(factory, time.Hour, 2, opts, nil)
+    defer sims.Close()
+
+    do := func(method, path, body string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        sims.APIHandler(w, httptest.NewRequest(method, path,
+            strings.NewReader(body)))
+        return w
+    }
+
+    for _, c := range []struct {
+        method, path, body string
+        code int
+    }{
+        {"POST", "/api/sims", `{"Name": "a", "Spec": {"Width": 8}}`, 201},
+        {"POST", "/api/sims", `{"Name": "a"}`, 409},
+        {"POST", "/api/sims", `{"Name": "b/c"}`, 400},
+        {"POST", "/api/sims", `{"Name": "b"}`, 201},
+        {"POST", "/api/sims", `{"Name": "c"}`, 409},
+        {"GET", "/api/sims/a", "", 200},
+        {"POST", "/api/sims/a/stop", "", 200},
+        {"DELETE", "/api/sims/b", "", 204},
+        {"DELETE", "/api/sims/b", "", 404},
+    } {
+        if w := do(c.method, c.path, c.body); w.Code != c.code {
+            t.Errorf("%s %s %s: expected %d, got %d: %s", c.method, c.path,
+                c.body, c.code, w.Code, w.Body)
+        }
+    }
+
+    viewers := NewSims(factory, time.Hour, 2, DefaultOptions, nil)
+    w := httptest.NewRecorder()
+    viewers.APIHandler(w, httptest.NewRequest("POST", "/api/sims",
+        strings.NewReader(`{"Name": "a"}`)))
+    if w.Code != 403 {
+        t.Errorf("expected 403 for viewer, got %d", w.Code)
+    }
+
+    var list []SimJSON
+    if err := json.NewDecoder(do("GET", "/api/sims", "").Body).
+        Decode(&list); err != nil {
+        t.Fatal(err)
+    }
+    if len(list) != 1 || list[0].Name != "a" || list[0].Running {
+        t.Fatalf("expected stopped simulation a, got %+v", list)
+    }
+
+    w = httptest.NewRecorder()
+    sims.SimHandler(w, httptest.NewRequest("GET", "/sim/a/env", nil))
+    var env EnvJSON
+    if err := json.NewDecoder(w.Body).Decode(&env); err != nil || env.Width != 8 {
+        t.Fatalf("expected env of simulation a, got %v, %v", env, err)
+    }
+    w = httptest.NewRecorder()
+    sims.SimHandler(w, httptest.NewRequest("GET", "/sim/b/env", nil))
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("expected deleted simulation to be gone, got %d", w.Code)
+    }
+}
+
+func TestSimsStopRunning(t *testing.T) {
+    factory := func(spec json.RawMessage) (SimParams, error) {
+        env, err := tp.NewEnv(8, 8, 16, 8, 1)
+        if err != nil {
+            return SimParams{}, err
+        }
+        dts := make(chan *tp.Delta)
+        go env.Run(2, 100 * time.Microsecond, dts)
+        return SimParams{
+            Env: env,
+            Deltas: dts,
+            History: tp.NewHistory(10, 4, 1, 2),
+        }, nil
+    }
+    opts := DefaultOptions
+    opts.Role = RoleOperator
+    opts.PollTimeout = time.Second
+    sims := NewSims(factory, time.Millisecond, 0, opts, nil)
+
+    for _, name := range []string{"a", "b"} {
+        if _, err := sims.Create(name, nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    time.Sleep(20 * time.Millisecond)
+
+    if err := sims.Stop("a"); err != nil {
+        t.Fatal(err)
+    }
+    w := httptest.NewRecorder()
+    sims.SimHandler(w, httptest.NewRequest("GET", "/sim/a/cell?x=0&y=0", nil))
+    if w.Code != http.StatusOK {
+        t.Fatalf("expected cell of stopped simulation, got %d", w.Code)
+    }
+
+    // New clients still receive a snapshot of the final state.
+    w = httptest.NewRecorder()
+    sims.SimHandler(w, httptest.NewRequest("GET", "/sim/a/poll", nil))
+    var poll PollJSON
+    if err := json.NewDecoder(w.Body).Decode(&poll); err != nil {
+        t.Fatal(err)
+    }
+    snapshot := false
+    for _, m := range poll.Messages {
+        var msg SnapshotMsg
+        if json.Unmarshal(m, &msg) == nil && msg.Type == MsgSnapshot {
+            snapshot = true
+        }
+    }
+    if !snapshot {
+        t.Fatalf("expected snapshot of stopped simulation, got %+v", poll)
+    }
+    sims.Close()
+    if len(sims.List()) != 0 {
+        t.Fatalf("expected no simulations, got %v", sims.List())
+    }
+}
@@ -0,0 +1,216 @@
+// This project is licensed under the MIT License (see LICENSE).
+
+package web
+
+import (
+    "fmt"
+    "net/url"
+    "strconv"
+
+    tp "tidepool/tidepool"
+)
+
+const (
+    // Cells with their genomes.
+    DetailFull = "full"
+    // Cells with colour keys only.
+    DetailColour = "colour"
+    // Aggregated tiles of Tile x Tile cells.
+    DetailTiles = "tiles"
+)
+
+// Subscription is the part of the grid a client receives and at which
+// level of detail.
+type Subscription struct {
+    X int32
+    Y int32
+    Width int32
+    Height int32
+    Detail string
+    Tile int32 `json:",omitempty"`
+    Colour string `json:",omitempty"`
+}
+
+// TileSummary aggregates the cells of a tile. Energy is the mean energy of
+// live cells and Key the most common colour key among viable cells.
+type TileSummary struct {
+    X int32
+    Y int32
+    Live int32
+    Viable int32
+    Energy int64
+    Key uint32
+}
+
+// validate clamps the viewport to the grid and checks the detail level.
+func (s *Subscription) validate(width, height int32) error {
+    switch s.Detail {
+    case DetailFull, DetailColour:
+    case DetailTiles:
+        if s.Tile < 1 {
+            return fmt.Errorf("invalid tile size: %d", s.Tile)
+        }
+    default:
+        return fmt.Errorf("invalid detail: %s", s.Detail)
+    }
+
+    if s.Colour == "" {
+        s.Colour = ColourGenotype
+    } else if !validColourMode(s.Colour) {
+        return fmt.Errorf("invalid colour mode: %s", s.Colour)
+    }
+
+    if s.X < 0 {
+        s.X = 0
+    }
+    if s.Y < 0 {
+        s.Y = 0
+    }
+    if s.Width <= 0 || s.X + s.Width > width {
+        s.Width = width - s.X
+    }
+    if s.Height <= 0 || s.Y + s.Height > height {
+        s.Height = height - s.Y
+    }
+    if s.Width <= 0 || s.Height <= 0 {
+        return fmt.Errorf("viewport outside of grid")
+    }
+
+    return nil
+}
+
+func (s Subscription) contains(x, y int32) bool {
+    return x >= s.X && x < s.X + s.Width && y >= s.Y && y < s.Y + s.Height
+}
+
+func (s Subscription) key() string {
+    return fmt.Sprint(s.X, s.Y, s.Width, s.Height, s.Detail, s.Tile, s.Colour)
+}
+
+// parseSubscription reads a subscription from the query parameters x, y,
+// w, h, detail, tile and colour. The legacy genomes parameter selects full detail.
+func parseSubscription(q url.Values, width, height int32) (Subscription, error) {
+    s := Subscription{
+        Width: width,
+        Height: height,
+        Detail: DetailColour,
+    }
+    if q.Get("genomes") != "" {
+        s.Detail = DetailFull
+    }
+    if v := q.Get("detail"); v != "" {
+        s.Detail = v
+    }
+    s.Colour = q.Get("colour")
+
+    for _, p := range []struct {
+        name string
+        v *int32
+    }{
+        {"x", &s.X}, {"y", &s.Y}, {"w", &s.Width}, {"h", &s.Height},
+        {"tile", &s.Tile},
+    } {
+        if v := q.Get(p.name); v != "" {
+            i, err := strconv.ParseInt(v, 10, 32)
+            if err != nil {
+                return s, err
+            }
+            *p.v = int32(i)
+        }
+    }
+
+    return s, s.validate(width, height)
+}
+
+func (c *Conn) coords(idx int32) (int32, int32) {
+    return idx % c.env.Width, idx / c.env.Width
+}
+
+func (c *Conn) filterDiffs(s Subscription, ds []CellDiff) []CellDiff {
+    if s.Width == c.env.Width && s.Height == c.env.Height {
+        return ds
+    }
+    f := make([]CellDiff, 0)
+    for _, d := range ds {
+        if s.contains(c.coords(d.Idx)) {
+            f = append(f, d)
+        }
+    }
+    return f
+}
+
+func (c *Conn) filterCells(s Subscription, cs []*tp.Cell) []*tp.Cell {
+    if s.Width == c.env.Width && s.Height == c.env.Height {
+        return cs
+    }
+    f := make([]*tp.Cell, 0)
+    for _, cell := range cs {
+        if s.contains(cell.X, cell.Y) {
+            f = append(f, cell)
+        }
+    }
+    return f
+}
+
+// tile summarizes the tile at tile coordinates tx, ty.
+func (c *Conn) tile(size, tx, ty int32, viableGen int64) TileSummary {
+    t := TileSummary{X: tx, Y: ty}
+    keys := make(map[uint32]int32)
+    var energy int64
+
+    for y := ty * size; y < (ty + 1) * size && y < c.env.Height; y++ {
+        for x := tx * size; x < (tx + 1) * size && x < c.env.Width; x++ {
+            s := c.shadow.cells[y * c.env.Width + x]
+            if s.Energy == 0 {
+                continue
+            }
+            t.Live++
+            energy += s.Energy
+            if s.Generation >= viableGen {
+                t.Viable++
+                keys[s.Key]++
+            }
+        }
+    }
+
+    if t.Live > 0 {
+        t.Energy = energy / int64(t.Live)
+    }
+    var n int32
+    for k, v := range keys {
+        if v > n || (v == n && k < t.Key) {
+            n = v
+            t.Key = k
+        }
+    }
+
+    return t
+}
+
+// tiles summarizes the tiles in the viewport of s. If ds is not nil, only
+// tiles containing a changed cell are included.
+func (c *Conn) tiles(s Subscription, ds []CellDiff) []TileSummary {
+    viableGen := c.env.GetConfig().ViableCellGeneration
+    ts := make([]TileSummary, 0)
+
+    if ds == nil {
+        for ty := s.Y / s.Tile; ty * s.Tile < s.Y + s.Height; ty++ {
+            for tx := s.X / s.Tile; tx * s.Tile < s.X + s.Width; tx++ {
+                ts = append(ts, c.tile(s.Tile, tx, ty, viableGen))
+            }
+        }
+        return ts
+    }
+
+    seen := make(map[[2]int32]bool)
+    for _, d := range c.filterDiffs(s, ds) {
+        x, y := c.coords(d.Idx)
+        k := [2]int32{x / s.Tile, y / s.Tile}
+        if seen[k] {
+            continue
+        }
+        seen[k] = true
+        ts = append(ts, c.tile(s.Tile, k[0], k[1], viableGen))
+    }
+    return ts
+}